@@ -0,0 +1,45 @@
+package rely
+
+// SendSnapshotPacket sends a packet like SendPacket, recording that it carries the application snapshot
+// with the given id. Once the peer acks the packet, the snapshot becomes the baseline returned by Baseline.
+// Snapshot ids must increase with every snapshot sent.
+func (e *Endpoint) SendSnapshotPacket(snapshot uint64, packetData []byte) {
+	sequence := e.sequence
+	e.SendPacket(packetData)
+	if e.sequence == sequence {
+		// the packet was dropped
+		return
+	}
+
+	sentPacketData := e.sentPackets.Find(sequence)
+	sentPacketData.Snapshot = snapshot
+	sentPacketData.HasSnapshot = true
+}
+
+// Baseline returns the most recent snapshot the peer is known to have received, to delta compress the
+// next snapshot against. There is no baseline until a snapshot packet is acked, nor once the packet that
+// carried it has left the sent packets buffer, at which point the next snapshot should be sent whole.
+func (e *Endpoint) Baseline() (snapshot uint64, ok bool) {
+	if !e.hasBaseline {
+		return 0, false
+	}
+	sentPacketData := e.sentPackets.Find(e.baselineSequence)
+	if sentPacketData == nil || !sentPacketData.HasSnapshot || sentPacketData.Snapshot != e.baseline {
+		e.hasBaseline = false
+		return 0, false
+	}
+	return e.baseline, true
+}
+
+// ackBaseline advances the baseline when a packet carrying a newer snapshot is acked
+func (e *Endpoint) ackBaseline(sequence uint16, sentPacketData *sentPacketData) {
+	if !sentPacketData.HasSnapshot {
+		return
+	}
+	if _, ok := e.Baseline(); ok && sentPacketData.Snapshot <= e.baseline {
+		return
+	}
+	e.baseline = sentPacketData.Snapshot
+	e.baselineSequence = sequence
+	e.hasBaseline = true
+}
@@ -0,0 +1,81 @@
+package rely
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestBaseline(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+	sender, receiver := context.sender, context.receiver
+
+	if _, ok := sender.Baseline(); ok {
+		t.Error("Baseline before anything was sent")
+	}
+
+	sender.SendSnapshotPacket(1, []byte{1})
+	if _, ok := sender.Baseline(); ok {
+		t.Error("Baseline before anything was acked")
+	}
+	receiver.SendPacket(nil)
+	if snapshot, ok := sender.Baseline(); !ok || snapshot != 1 {
+		t.Error("Expected baseline 1, got", snapshot, ok)
+	}
+
+	// snapshot 2 is lost, 3 arrives, and packets without snapshots do not matter
+	context.drop = 1
+	sender.SendSnapshotPacket(2, []byte{2})
+	context.drop = 0
+	sender.SendSnapshotPacket(3, make([]byte, 3000))
+	sender.SendPacket([]byte{4})
+	receiver.SendPacket(nil)
+	if snapshot, ok := sender.Baseline(); !ok || snapshot != 3 {
+		t.Error("Expected baseline 3, got", snapshot, ok)
+	}
+
+	// a late ack of an older snapshot does not move the baseline back
+	var late []byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		late = append([]byte(nil), packetData...)
+	}
+	sender.SendSnapshotPacket(5, []byte{5})
+	sender.config.TransmitPacketFunction = testTransmitPacketFunction
+	sender.SendSnapshotPacket(6, []byte{6})
+	receiver.SendPacket(nil)
+	if snapshot, ok := sender.Baseline(); !ok || snapshot != 6 {
+		t.Error("Expected baseline 6, got", snapshot, ok)
+	}
+	receiver.ReceivePacket(late)
+	receiver.SendPacket(nil)
+	if snapshot, ok := sender.Baseline(); !ok || snapshot != 6 {
+		t.Error("Expected baseline to stay 6, got", snapshot, ok)
+	}
+
+	// the baseline expires once its packet leaves the sent packets buffer
+	context.drop = 1
+	for i := 0; i < sender.config.SentPacketsBufferSize-1; i++ {
+		sender.SendPacket([]byte{1})
+	}
+	if _, ok := sender.Baseline(); !ok {
+		t.Error("Baseline expired early")
+	}
+	sender.SendPacket([]byte{1})
+	if _, ok := sender.Baseline(); ok {
+		t.Error("Baseline did not expire")
+	}
+	context.drop = 0
+
+	sender.SendSnapshotPacket(7, []byte{7})
+	receiver.SendPacket(nil)
+	if snapshot, ok := sender.Baseline(); !ok || snapshot != 7 {
+		t.Error("Expected baseline 7, got", snapshot, ok)
+	}
+	sender.Reset()
+	if _, ok := sender.Baseline(); ok {
+		t.Error("Baseline survived a reset")
+	}
+}
@@ -0,0 +1,127 @@
+package rely
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// newBenchEndpoints creates endpoints that send to each other through a pool, as a server would run them
+func newBenchEndpoints(context *testContext) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	pool := NewPool(0)
+	newTestEndpoints(context, 100, func(config *Config) {
+		config.Allocate = pool.Allocate
+		config.Free = pool.Free
+		config.ProcessPacketFunction = func(interface{}, int, uint16, []byte) bool {
+			return true
+		}
+	})
+}
+
+func benchmarkSend(b *testing.B, packetBytes int) {
+	var context testContext
+	newBenchEndpoints(&context)
+	context.sender.config.TransmitPacketFunction = func(interface{}, int, uint16, []byte) {}
+	packetData := make([]byte, packetBytes)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(packetBytes))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		context.sender.SendPacket(packetData)
+	}
+}
+
+func BenchmarkEndpoint_Send(b *testing.B) {
+	benchmarkSend(b, 100)
+}
+
+func BenchmarkEndpoint_SendFragmented(b *testing.B) {
+	benchmarkSend(b, 3000)
+}
+
+func BenchmarkEndpoint_Receive(b *testing.B) {
+	var context testContext
+	newBenchEndpoints(&context)
+	packetData := make([]byte, 100+MaxPacketHeaderBytes)
+
+	b.ReportAllocs()
+	b.SetBytes(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		header := PacketHeader{Sequence: uint16(i), Ack: uint16(i), AckBits: 0xFFFFFFFF}
+		headerBytes, _ := header.Marshal(packetData)
+		context.receiver.ReceivePacket(packetData[:headerBytes+100])
+	}
+}
+
+func BenchmarkEndpoint_SendReceiveFragmented(b *testing.B) {
+	var context testContext
+	newBenchEndpoints(&context)
+	packetData := make([]byte, 3000)
+
+	b.ReportAllocs()
+	b.SetBytes(3000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		context.sender.SendPacket(packetData)
+	}
+}
+
+func BenchmarkEndpoint_Update(b *testing.B) {
+	var context testContext
+	newBenchEndpoints(&context)
+	packetData := make([]byte, 100)
+	for i := 0; i < 1000; i++ {
+		context.sender.SendPacket(packetData)
+		context.receiver.SendPacket(packetData)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// steady traffic both ways, as Update sees it on a server
+		context.sender.SendPacket(packetData)
+		context.receiver.SendPacket(packetData)
+		context.sender.Update(100 + float64(i)/60)
+	}
+}
+
+// TestEndpoint_ZeroAllocations guards the hot paths against allocating once they reach a steady state
+func TestEndpoint_ZeroAllocations(t *testing.T) {
+	if raceEnabled {
+		t.Skip("the race detector allocates")
+	}
+	var context testContext
+	newBenchEndpoints(&context)
+	small, large := make([]byte, 100), make([]byte, 3000)
+
+	tests := []struct {
+		name string
+		run  func()
+	}{
+		{"send and receive", func() {
+			context.sender.SendPacket(small)
+			context.receiver.SendPacket(small)
+		}},
+		{"fragmented send and receive", func() {
+			context.sender.SendPacket(large)
+		}},
+		{"ack", func() {
+			context.receiver.SendAck()
+		}},
+		{"update", func() {
+			context.sender.Update(context.sender.time + 1.0/60)
+		}},
+	}
+
+	for _, test := range tests {
+		// warm up the pool
+		test.run()
+		if allocs := testing.AllocsPerRun(100, test.run); allocs != 0 {
+			t.Error(test.name, "allocated", allocs, "times per run")
+		}
+	}
+}
@@ -6,24 +6,12 @@ import (
 
 // buffer is a helper struct for serializing and deserializing as the caller
 // does not need to externally manage where in the buffer they are currently reading or writing to.
+// It is used by value on the stack, so serializing does not allocate.
 type buffer struct {
 	buf []byte
 	pos int
 }
 
-func newBuffer(size int) *buffer {
-	b := &buffer{}
-	b.buf = make([]byte, size)
-	return b
-}
-
-func newBufferFromRef(buf []byte) *buffer {
-	b := &buffer{}
-	b.buf = buf
-	b.pos = 0
-	return b
-}
-
 func (b *buffer) bytes() []byte {
 	return b.buf[:b.pos]
 }
@@ -66,6 +54,19 @@ func (b *buffer) getUint16() (uint16, error) {
 	return n, nil
 }
 
+func (b *buffer) getUint32() (uint32, error) {
+	var n uint32
+	buf, err := b.getBytes(sizeUint32)
+	if err != nil {
+		return 0, nil
+	}
+	n |= uint32(buf[0])
+	n |= uint32(buf[1]) << 8
+	n |= uint32(buf[2]) << 16
+	n |= uint32(buf[3]) << 24
+	return n, nil
+}
+
 func (b *buffer) writeBytes(src []byte) {
 	b.pos += copy(b.buf[b.pos:], src)
 }
@@ -82,7 +83,19 @@ func (b *buffer) writeUint16(n uint16) {
 	b.pos++
 }
 
+func (b *buffer) writeUint32(n uint32) {
+	b.buf[b.pos] = byte(n)
+	b.pos++
+	b.buf[b.pos] = byte(n >> 8)
+	b.pos++
+	b.buf[b.pos] = byte(n >> 16)
+	b.pos++
+	b.buf[b.pos] = byte(n >> 24)
+	b.pos++
+}
+
 const (
 	sizeUint8  = 1
 	sizeUint16 = 2
+	sizeUint32 = 4
 )
@@ -76,39 +76,17 @@ func main() {
 	}
 }
 
-// custom allocate/free to avoid gc
-var cache = map[int][][]byte{}
-
-func poolAllocate(size int) []byte {
-	entry := cache[size]
-
-	if entry == nil {
-		cache[size] = [][]byte{}
-		return make([]byte, size)
-	}
-
-	if len(entry) == 0 {
-		return make([]byte, size)
-	}
-
-	data := entry[len(entry) - 1]
-	cache[size] = entry[:len(entry) - 1]
-	return data
-}
-
-func poolFree(data []byte) {
-	cache[len(data)] = append(cache[len(data)], data)
-}
-
 func initialize() {
 	clientConfig := rely.NewDefaultConfig()
 	serverConfig := rely.NewDefaultConfig()
 
 	if *pool {
-		clientConfig.Allocate = poolAllocate
-		clientConfig.Free = poolFree
-		serverConfig.Allocate = poolAllocate
-		serverConfig.Free = poolFree
+		// custom allocate/free to avoid gc
+		memoryPool := rely.NewPool(0)
+		clientConfig.Allocate = memoryPool.Allocate
+		clientConfig.Free = memoryPool.Free
+		serverConfig.Allocate = memoryPool.Allocate
+		serverConfig.Free = memoryPool.Free
 	}
 
 	clientConfig.FragmentAbove = 500
@@ -0,0 +1,166 @@
+package rely
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// reliableVectors are the wire format vectors in testdata/reliable.txt, generated by the C library
+type reliableVectors struct {
+	headers   []reliableHeaderVector
+	datagrams map[int][][]byte // keyed by packet bytes
+	sizes     []int            // packet bytes in the order they were sent
+}
+
+type reliableHeaderVector struct {
+	header PacketHeader
+	data   []byte
+}
+
+func loadReliableVectors(t *testing.T) *reliableVectors {
+	f, err := os.Open("testdata/reliable.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	vectors := &reliableVectors{datagrams: map[int][][]byte{}}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<16)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		data, err := hex.DecodeString(fields[len(fields)-1])
+		if err != nil {
+			t.Fatal(line, err)
+		}
+		switch fields[0] {
+		case "packet":
+			var v reliableHeaderVector
+			if _, err = fmt.Sscanf(line, "packet %d %d %v", &v.header.Sequence, &v.header.Ack, &v.header.AckBits); err != nil {
+				t.Fatal(line, err)
+			}
+			v.data = data
+			vectors.headers = append(vectors.headers, v)
+		case "datagram":
+			var packetBytes int
+			var sequence uint16
+			if _, err = fmt.Sscanf(line, "datagram %d %d", &packetBytes, &sequence); err != nil {
+				t.Fatal(line, err)
+			}
+			if _, ok := vectors.datagrams[packetBytes]; !ok {
+				vectors.sizes = append(vectors.sizes, packetBytes)
+			}
+			vectors.datagrams[packetBytes] = append(vectors.datagrams[packetBytes], data)
+		default:
+			t.Fatal("unknown vector", line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+func reliableTestPayload(packetBytes int) []byte {
+	packetData := make([]byte, packetBytes)
+	for i := range packetData {
+		packetData[i] = byte(i)
+	}
+	return packetData
+}
+
+func TestReliableCompatibility_PacketHeader(t *testing.T) {
+	vectors := loadReliableVectors(t)
+	if len(vectors.headers) < 32 {
+		t.Fatal("expected a vector for every prefix byte combination, got", len(vectors.headers))
+	}
+
+	prefixBytes := map[byte]bool{}
+	for _, v := range vectors.headers {
+		prefixBytes[v.data[0]] = true
+
+		packetData := make([]byte, MaxPacketHeaderBytes)
+		n, err := v.header.Marshal(packetData)
+		if err != nil || !bytes.Equal(packetData[:n], v.data) {
+			t.Errorf("%+v marshaled to %x, reliable.io wrote %x (%v)", v.header, packetData[:n], v.data, err)
+		}
+
+		var header PacketHeader
+		n, err = header.Unmarshal(v.data)
+		if err != nil || n != len(v.data) || header != v.header {
+			t.Errorf("%x unmarshaled to %+v, expected %+v (%v)", v.data, header, v.header, err)
+		}
+	}
+	if len(prefixBytes) != 32 {
+		t.Error("expected all 32 prefix bytes to be covered, got", len(prefixBytes))
+	}
+}
+
+type reliableCompatibilityContext struct {
+	transmitted [][]byte
+	received    [][]byte
+}
+
+func reliableCompatibilityConfig(context *reliableCompatibilityContext) *Config {
+	config := NewDefaultConfig()
+	config.ReliableIOCompatible = true
+	config.Context = context
+	config.TransmitPacketFunction = func(context interface{}, _ int, _ uint16, packetData []byte) {
+		ctx := context.(*reliableCompatibilityContext)
+		ctx.transmitted = append(ctx.transmitted, append([]byte(nil), packetData...))
+	}
+	config.ProcessPacketFunction = func(context interface{}, _ int, _ uint16, packetData []byte) bool {
+		ctx := context.(*reliableCompatibilityContext)
+		ctx.received = append(ctx.received, append([]byte(nil), packetData...))
+		return true
+	}
+	return config
+}
+
+func TestReliableCompatibility_Send(t *testing.T) {
+	vectors := loadReliableVectors(t)
+
+	var context reliableCompatibilityContext
+	endpoint := NewEndpoint(reliableCompatibilityConfig(&context), 100)
+
+	for _, packetBytes := range vectors.sizes {
+		context.transmitted = context.transmitted[:0]
+		endpoint.SendPacket(reliableTestPayload(packetBytes))
+
+		expected := vectors.datagrams[packetBytes]
+		if len(context.transmitted) != len(expected) {
+			t.Fatal("sending", packetBytes, "bytes transmitted", len(context.transmitted), "datagrams, reliable.io transmitted", len(expected))
+		}
+		for i := range expected {
+			if !bytes.Equal(context.transmitted[i], expected[i]) {
+				t.Errorf("sending %d bytes, datagram %d differs from reliable.io:\n%x\n%x", packetBytes, i, context.transmitted[i], expected[i])
+			}
+		}
+	}
+}
+
+func TestReliableCompatibility_Receive(t *testing.T) {
+	vectors := loadReliableVectors(t)
+
+	var context reliableCompatibilityContext
+	endpoint := NewEndpoint(reliableCompatibilityConfig(&context), 100)
+
+	for _, packetBytes := range vectors.sizes {
+		context.received = context.received[:0]
+		for _, datagram := range vectors.datagrams[packetBytes] {
+			endpoint.ReceivePacket(datagram)
+		}
+		if len(context.received) != 1 || !bytes.Equal(context.received[0], reliableTestPayload(packetBytes)) {
+			t.Error("failed to receive the", packetBytes, "byte packet sent by reliable.io")
+		}
+	}
+}
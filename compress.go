@@ -0,0 +1,184 @@
+package rely
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Compressor compresses packet payloads, see Config.Compressor. It is used by SendPacket and ReceivePacket,
+// so it must be safe for concurrent use if the endpoints sharing it are used concurrently.
+type Compressor interface {
+	// Compress writes the compressed src to dst and returns the number of bytes written, or an error if
+	// the result does not fit in dst
+	Compress(dst, src []byte) (int, error)
+	// Decompress writes the decompressed src to dst and returns the number of bytes written, or an error
+	// if src is not valid or the result does not fit in dst
+	Decompress(dst, src []byte) (int, error)
+}
+
+// ErrCompressedTooLarge is returned by a Compressor when the result does not fit the destination
+var ErrCompressedTooLarge = errors.New("rely: compressed data does not fit")
+
+// FlateCompressor is a Compressor using DEFLATE, optionally with a preset dictionary of data that is
+// typical of the payloads. A dictionary helps a lot with small payloads, which otherwise have little
+// to refer back to. Both endpoints must use the same dictionary.
+type FlateCompressor struct {
+	level      int
+	dictionary []byte
+	writers    sync.Pool
+	readers    sync.Pool
+}
+
+type flateReader struct {
+	source bytes.Reader
+	reader io.ReadCloser
+}
+
+// NewFlateCompressor creates a compressor with a compression level from flate.BestSpeed to
+// flate.BestCompression, and a dictionary which may be nil
+func NewFlateCompressor(level int, dictionary []byte) (*FlateCompressor, error) {
+	if _, err := flate.NewWriterDict(io.Discard, level, dictionary); err != nil {
+		return nil, err
+	}
+	return &FlateCompressor{level: level, dictionary: dictionary}, nil
+}
+
+// Compress implements Compressor
+func (c *FlateCompressor) Compress(dst, src []byte) (int, error) {
+	w := fixedWriter{buf: dst}
+	writer, _ := c.writers.Get().(*flate.Writer)
+	if writer == nil {
+		writer, _ = flate.NewWriterDict(&w, c.level, c.dictionary)
+	} else {
+		writer.Reset(&w)
+	}
+	defer c.writers.Put(writer)
+
+	if _, err := writer.Write(src); err != nil {
+		return 0, err
+	}
+	if err := writer.Close(); err != nil {
+		return 0, err
+	}
+	return w.pos, nil
+}
+
+// Decompress implements Compressor
+func (c *FlateCompressor) Decompress(dst, src []byte) (int, error) {
+	r, _ := c.readers.Get().(*flateReader)
+	if r == nil {
+		r = &flateReader{}
+		r.source.Reset(src)
+		r.reader = flate.NewReaderDict(&r.source, c.dictionary)
+	} else {
+		r.source.Reset(src)
+		if err := r.reader.(flate.Resetter).Reset(&r.source, c.dictionary); err != nil {
+			return 0, err
+		}
+	}
+	defer c.readers.Put(r)
+
+	// only the end of the stream ends the payload, a truncated stream fails with io.ErrUnexpectedEOF
+	n := 0
+	for n < len(dst) {
+		m, err := r.reader.Read(dst[n:])
+		n += m
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	// dst is full, so there must be nothing left
+	var extra [1]byte
+	m, err := r.reader.Read(extra[:])
+	switch {
+	case m > 0 || err == nil:
+		return 0, ErrCompressedTooLarge
+	case err != io.EOF:
+		return 0, err
+	}
+	return n, nil
+}
+
+// fixedWriter writes to a buffer that does not grow
+type fixedWriter struct {
+	buf []byte
+	pos int
+}
+
+func (w *fixedWriter) Write(p []byte) (int, error) {
+	if len(p) > len(w.buf)-w.pos {
+		return 0, ErrCompressedTooLarge
+	}
+	w.pos += copy(w.buf[w.pos:], p)
+	return len(p), nil
+}
+
+// compressor returns the compressor to use, none when keeping to the reliable.io wire format
+func (c *Config) compressor() Compressor {
+	if c.ReliableIOCompatible {
+		return nil
+	}
+	return c.Compressor
+}
+
+// compressPayload returns the compressed payload and the buffer holding it, or the payload and nil if
+// compressing does not make it smaller
+func (e *Endpoint) compressPayload(packetData []byte) ([]byte, []byte) {
+	if len(packetData) < 2 {
+		return packetData, nil
+	}
+	e.counters[counterNumBytesBeforeCompression] += uint64(len(packetData))
+
+	compressed := e.allocate(len(packetData) - 1)
+	if compressed == nil {
+		log.Errorf("[%s] could not allocate %d bytes to compress packet, sending it uncompressed", e.config.Name, len(packetData)-1)
+		e.counters[counterNumAllocationsFailed]++
+		e.counters[counterNumBytesAfterCompression] += uint64(len(packetData))
+		return packetData, nil
+	}
+	n, err := e.config.Compressor.Compress(compressed, packetData)
+	if err != nil {
+		// incompressible data usually ends up here as it does not fit
+		debugf("[%s] not compressing packet: %v", e.config.Name, err)
+		e.free(compressed)
+		e.counters[counterNumBytesAfterCompression] += uint64(len(packetData))
+		return packetData, nil
+	}
+	e.counters[counterNumBytesAfterCompression] += uint64(n)
+	e.counters[counterNumPacketsCompressed]++
+	return compressed[:n], compressed
+}
+
+// decompressPayload returns the decompressed payload and the buffer holding it
+func (e *Endpoint) decompressPayload(packetData []byte) ([]byte, []byte, error) {
+	if e.config.compressor() == nil {
+		return nil, nil, errors.New("rely: no Compressor configured")
+	}
+	decompressed := e.allocate(e.config.MaxPacketSize)
+	if decompressed == nil {
+		e.counters[counterNumAllocationsFailed]++
+		return nil, nil, errors.New("rely: could not allocate buffer to decompress into")
+	}
+	n, err := e.config.Compressor.Decompress(decompressed, packetData)
+	if err != nil {
+		e.free(decompressed)
+		return nil, nil, err
+	}
+	return decompressed[:n], decompressed, nil
+}
+
+// CompressionRatio returns the bytes of payloads sent after compression divided by the bytes before, for
+// all payloads given to Config.Compressor. It is 1 until a payload is compressed.
+func (e *Endpoint) CompressionRatio() float64 {
+	before := e.counters[counterNumBytesBeforeCompression]
+	if before == 0 {
+		return 1
+	}
+	return float64(e.counters[counterNumBytesAfterCompression]) / float64(before)
+}
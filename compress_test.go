@@ -0,0 +1,129 @@
+package rely
+
+import (
+	"bytes"
+	"compress/flate"
+	"math/rand"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestFlateCompressor(t *testing.T) {
+	dictionary := bytes.Repeat([]byte("player position velocity "), 8)
+	for _, dict := range [][]byte{nil, dictionary} {
+		compressor, err := NewFlateCompressor(flate.DefaultCompression, dict)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := bytes.Repeat([]byte("player position 1 2 3 velocity 4 5 6 "), 4)
+		compressed := make([]byte, len(src))
+		n, err := compressor.Compress(compressed, src)
+		if err != nil || n >= len(src) {
+			t.Fatal("Expected compression, got", n, err)
+		}
+
+		decompressed := make([]byte, 1024)
+		m, err := compressor.Decompress(decompressed, compressed[:n])
+		if err != nil || !bytes.Equal(decompressed[:m], src) {
+			t.Error("Decompressed does not match", err)
+		}
+		if _, err := compressor.Decompress(decompressed, compressed[:n-1]); err == nil {
+			t.Error("Expected an error when decompressing a truncated stream")
+		}
+		if _, err := compressor.Decompress(decompressed[:len(src)-1], compressed[:n]); err == nil {
+			t.Error("Expected an error when decompressing into a buffer that is too small")
+		}
+		if _, err := compressor.Compress(compressed[:4], src); err == nil {
+			t.Error("Expected an error when compressing into a buffer that is too small")
+		}
+	}
+
+	if _, err := NewFlateCompressor(42, nil); err == nil {
+		t.Error("Expected an error for an invalid level")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	compressor, _ := NewFlateCompressor(flate.DefaultCompression, nil)
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.Compressor = compressor
+	})
+	sender, receiver := context.sender, context.receiver
+
+	var sent [][]byte
+	transmit := sender.config.TransmitPacketFunction
+	sender.config.TransmitPacketFunction = func(context interface{}, index int, sequence uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+		transmit(context, index, sequence, packetData)
+	}
+	var processed [][]byte
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) bool {
+		processed = append(processed, append([]byte(nil), packetData...))
+		return true
+	}
+
+	// a compressible payload that would otherwise be fragmented fits in one packet
+	compressible := bytes.Repeat([]byte{1, 2, 3, 4}, 1000)
+	sender.SendPacket(compressible)
+	var header PacketHeader
+	if _, err := header.Unmarshal(sent[0]); err != nil || !header.Compressed || len(sent) != 1 {
+		t.Fatal("Expected one compressed packet, got", len(sent), header, err)
+	}
+
+	// an incompressible one is sent as it is
+	incompressible := make([]byte, 500)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	sender.SendPacket(incompressible)
+	if _, err := header.Unmarshal(sent[1]); err != nil || header.Compressed {
+		t.Fatal("Expected an uncompressed packet", header, err)
+	}
+
+	if len(processed) != 2 || !bytes.Equal(processed[0], compressible) || !bytes.Equal(processed[1], incompressible) {
+		t.Fatal("Payloads do not match")
+	}
+	if sender.PacketsCompressed() != 1 {
+		t.Error("Expected 1 compressed packet, got", sender.PacketsCompressed())
+	}
+	if ratio := sender.CompressionRatio(); ratio <= 0 || ratio > .2 {
+		t.Error("Expected the compressible payload to dominate the ratio, got", ratio)
+	}
+
+	// compression works with fragments and redundant payloads
+	sender.config.RedundantPayloads = 2
+	large := bytes.Repeat([]byte("large snapshot "), 1000)
+	fragmented := make([]byte, 3000)
+	rand.New(rand.NewSource(2)).Read(fragmented)
+	for i := 0; i < 3; i++ {
+		sender.SendPacket([]byte{byte(i), 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	}
+	sender.SendPacket(large)
+	sender.SendPacket(fragmented)
+	if len(processed) != 7 || !bytes.Equal(processed[4], []byte{2, 0, 0, 0, 0, 0, 0, 0, 0, 0}) ||
+		!bytes.Equal(processed[5], large) || !bytes.Equal(processed[6], fragmented) {
+		t.Error("Payloads do not match")
+	}
+
+	// a truncated packet is invalid rather than delivered in part
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+	}
+	sender.config.RedundantPayloads = 0
+	sender.SendPacket(large)
+	truncated := sent[len(sent)-1]
+	receiver.ReceivePacket(truncated[:len(truncated)-7])
+	if len(processed) != 7 || receiver.counters[counterNumPacketsInvalid] != 1 {
+		t.Fatal("Expected truncated packet to be invalid", len(processed), receiver.counters[counterNumPacketsInvalid])
+	}
+	sender.config.TransmitPacketFunction = transmit
+
+	// an endpoint without a compressor cannot read compressed packets
+	receiver.config.Compressor = nil
+	sender.SendPacket(compressible)
+	if len(processed) != 7 || receiver.counters[counterNumPacketsInvalid] != 2 {
+		t.Error("Expected compressed packet to be invalid", len(processed), receiver.counters[counterNumPacketsInvalid])
+	}
+}
@@ -1,5 +1,10 @@
 package rely
 
+import (
+	"errors"
+	"fmt"
+)
+
 // Config holds endpoint configuration data
 type Config struct {
 	Name                         string
@@ -18,13 +23,99 @@ type Config struct {
 	BandwidthSmoothingFactor     float64
 	PacketHeaderSize             int
 
+	// ReliableIOCompatible keeps the endpoint to the wire format of reliable.io, so that it can talk to
+	// endpoints using the C library. Validate rejects options that extend the wire format while it is set.
+	ReliableIOCompatible bool
+
+	// ProtocolId and ProtocolVersion are appended to every datagram when either is set. Datagrams
+	// without a matching id and version are rejected, so both endpoints must use the same values.
+	ProtocolId      uint32
+	ProtocolVersion uint16
+	// AckWindow is how many of the most recently received packets every sent packet acks, 32 or 64.
+	// The default of 32 is what reliable.io uses, 64 keeps acks alive through longer bursts of loss at
+	// high send rates for 4 more bytes of header. Each endpoint picks its own, the header says which.
+	AckWindow int
+	// KeepaliveInterval makes Update send an ack-only packet when nothing has been sent for this many
+	// seconds, so the peer keeps getting acks and its RTT and packet loss stay current. Zero disables it.
+	KeepaliveInterval float64
+	// Timeout is how many seconds Update waits without receiving a valid packet before the endpoint times
+	// out and OnTimeout is called. Zero disables it. Pair it with KeepaliveInterval on both endpoints so
+	// that a quiet peer is not mistaken for a missing one.
+	Timeout float64
+	// ExtendedSequences reconstructs the full 64 bit sequence of received packets, see Endpoint.ExtendSequence.
+	// It also lets the endpoint resynchronize with a peer that moved more than half the 16 bit sequence
+	// space ahead during a long stall, instead of dropping its packets as stale until the sequence wraps.
+	ExtendedSequences bool
+	// Checksum appends a CRC32C of every datagram, and drops received datagrams that fail to match
+	Checksum bool
+	// JitterBuffer holds received packets and delivers them from Update at the steady rate the peer sends
+	// them at, so that jitter does not reach the application. Packets are delivered in sequence order, late
+	// by PlayoutDelay or more, and packets that arrive after a later one was delivered are dropped. It is
+	// meant for packets sent at a fixed rate, like snapshots. Packets are acked when they arrive.
+	JitterBuffer bool
+	// PlayoutDelay is the least seconds the jitter buffer holds packets for beyond their expected arrival.
+	// The delay grows to cover three times the measured jitter.
+	PlayoutDelay float64
+	// MaxPlayoutDelay caps the playout delay in seconds. Zero means no cap.
+	MaxPlayoutDelay float64
+	// OrderedDelivery delivers packets in sequence order. Packets that arrive ahead of a missing one are
+	// held until it arrives, or until MaxReorderWait passes and Update skips it. Packets that arrive after
+	// they were skipped are dropped. Packets are acked when they arrive. JitterBuffer already delivers in
+	// order, so the two cannot be combined.
+	OrderedDelivery bool
+	// MaxReorderWait is how many seconds ordered delivery waits for a missing packet
+	MaxReorderWait float64
+	// FragmentRedundancy sends parity fragments with fragmented packets, so that the receiver can rebuild
+	// lost fragments instead of losing the whole packet. It is the number of parity fragments per fragment,
+	// from 0 (none) to 1, rounded up: .25 sends one for every 4 fragments and can rebuild up to a quarter of
+	// them, as long as no two lost fragments are a multiple of the parity count apart. Receivers always
+	// use parity fragments, but endpoints from before it was added reject them as invalid.
+	FragmentRedundancy float64
+	// RedundantPayloads makes every regular packet carry copies of up to this many of the most recent
+	// payloads that have not been acked, as far as they fit under FragmentAbove, so that a lost payload
+	// still arrives with the next packet. The receiver processes each payload once, in front of the packet
+	// that carried it. This is the usual way to send player input. Payloads that are fragmented are not
+	// copied. At most 255, zero disables it.
+	RedundantPayloads int
+	// Compressor compresses payloads before they are sent, see FlateCompressor. Payloads that do not get
+	// smaller are sent as they are, and the packet header says which are compressed. The receiving endpoint
+	// needs a Compressor that can decompress them, which for a dictionary means the same dictionary.
+	Compressor Compressor
+	// SendBudgetKbps is the rate Update sends packets from QueuePacket at. Zero derives it from the acked
+	// bandwidth, with some headroom so that it can grow, but no lower than MinSendBudgetKbps. With
+	// CongestionAvoidance the rate of its current mode is used instead, and with a CongestionController its
+	// pacing rate.
+	SendBudgetKbps float64
+	// MinSendBudgetKbps is the least rate queued packets are sent at when the budget is derived, which is
+	// also the rate they start at before anything was acked. Zero uses 256.
+	MinSendBudgetKbps float64
+	// CongestionAvoidance drops the send rate from GoodSendRateKbps to BadSendRateKbps while the RTT is over
+	// CongestionRtt milliseconds or the packet loss over CongestionPacketLoss percent, and goes back once
+	// they have been under for a few seconds, longer if the link keeps going bad. See RecommendedSendRate.
+	CongestionAvoidance  bool
+	CongestionRtt        float64
+	CongestionPacketLoss float64
+	GoodSendRateKbps     float64
+	BadSendRateKbps      float64
+	// CongestionController is told about the packets sent, acked and lost, and limits the send queue to its
+	// window and pacing rate, see AIMDController and LEDBATController. It cannot be combined with
+	// CongestionAvoidance.
+	CongestionController CongestionController
+
 	// TransmitPacketFunction is called by SendPacket to do the actual transmitting of packets
 	TransmitPacketFunction func(interface{}, int, uint16, []byte)
-	// ProcessPacketFunction is called by ReceivePacket once a fully assembled packet is received
+	// ProcessPacketFunction is called by ReceivePacket once a fully assembled packet is received, or by
+	// Update when JitterBuffer or OrderedDelivery hold it back. Packets are acked when it returns true,
+	// except with JitterBuffer or OrderedDelivery where the return value is ignored. Duplicates of an acked
+	// packet are dropped, so it is called at most once for each packet it accepts.
 	ProcessPacketFunction func(interface{}, int, uint16, []byte) bool
-	// Allocate can be used to implement custom memory allocation
+	// OnTimeout is called by Update when the endpoint times out, see Timeout
+	OnTimeout func(interface{}, int)
+	// Allocate can be used to implement custom memory allocation, see Pool. When it returns nil the
+	// packet or fragment that needed the memory is dropped. The allocator is fixed by NewEndpoint, changes to
+	// it are ignored by Endpoint.Reconfigure.
 	Allocate func(int) []byte
-	// Free can be used to implement custom memory allocation
+	// Free can be used to implement custom memory allocation, along with Allocate
 	Free func([]byte)
 }
 
@@ -44,5 +135,215 @@ func NewDefaultConfig() *Config {
 		PacketLossSmoothingFactor:    .1,
 		BandwidthSmoothingFactor:     .1,
 		PacketHeaderSize:             28, // // note: UDP over IPv4 = 20 + 8 bytes, UDP over IPv6 = 40 + 8 bytes
+		AckWindow:                    32,
+		MinSendBudgetKbps:            defaultMinSendBudgetKbps,
+		CongestionRtt:                250,
+		CongestionPacketLoss:         10,
+		GoodSendRateKbps:             256,
+		BadSendRateKbps:              64,
+	}
+}
+
+// NewLANConfig is for peers on the same local network. RTT samples are clean, so they are smoothed less
+// and loss is noticed quickly. Peers that go quiet are timed out after a few seconds.
+func NewLANConfig() *Config {
+	config := NewDefaultConfig()
+	config.RttSmoothingFactor = .01
+	config.PacketLossSmoothingFactor = .25
+	config.KeepaliveInterval = .25
+	config.Timeout = 5
+	return config
+}
+
+// NewWANConfig is for peers across the internet. Fragments stay at 1024 bytes so datagrams fit the
+// minimum IPv6 MTU, datagrams are checksummed because the UDP checksum is weak, and keepalives keep
+// NAT mappings open.
+func NewWANConfig() *Config {
+	config := NewDefaultConfig()
+	config.Checksum = true
+	config.KeepaliveInterval = 1
+	config.Timeout = 10
+	return config
+}
+
+// NewMobileConfig is for peers on cellular networks, which see bursty loss, large jitter and gaps during
+// handovers. Acks cover 64 packets to survive loss bursts, loss is smoothed more to ride out the bursts,
+// and peers are given longer before timing out. Headers are counted as UDP over IPv6.
+func NewMobileConfig() *Config {
+	config := NewDefaultConfig()
+	config.AckWindow = 64
+	config.PacketLossSmoothingFactor = .05
+	config.PacketHeaderSize = 48
+	config.Checksum = true
+	config.KeepaliveInterval = 1
+	config.Timeout = 20
+	return config
+}
+
+// NewHighRateConfig is for sending at 120Hz or more. The sequence buffers hold about 8 seconds of packets
+// at 120Hz, acks cover 64 packets, and RTT is smoothed over the extra samples so that it reacts about
+// as fast as the default does at 60Hz.
+func NewHighRateConfig() *Config {
+	config := NewDefaultConfig()
+	config.AckWindow = 64
+	config.AckBufferSize = 1024
+	config.SentPacketsBufferSize = 1024
+	config.ReceivedPacketsBufferSize = 1024
+	config.RttSmoothingFactor = .00125
+	config.KeepaliveInterval = .1
+	config.Timeout = 10
+	return config
+}
+
+// NewLargePayloadConfig is for sending packets of up to 256KB, such as full snapshots or level data.
+// Packets are split into up to 256 fragments, the most the fragment header allows, and fewer packets
+// are reassembled at once since each one can hold a lot of memory.
+func NewLargePayloadConfig() *Config {
+	config := NewDefaultConfig()
+	config.MaxFragments = 256
+	config.MaxPacketSize = 256 * 1024
+	config.FragmentReassemblyBufferSize = 16
+	config.Checksum = true
+	config.KeepaliveInterval = 1
+	config.Timeout = 10
+	return config
+}
+
+// NewPresetConfig creates the config for a preset by name, one of "default", "lan", "wan", "mobile",
+// "high-rate" or "large-payload". The wan, mobile and large-payload presets checksum datagrams, so
+// both endpoints need to use one of them.
+func NewPresetConfig(name string) (*Config, error) {
+	switch name {
+	case "default":
+		return NewDefaultConfig(), nil
+	case "lan":
+		return NewLANConfig(), nil
+	case "wan":
+		return NewWANConfig(), nil
+	case "mobile":
+		return NewMobileConfig(), nil
+	case "high-rate":
+		return NewHighRateConfig(), nil
+	case "large-payload":
+		return NewLargePayloadConfig(), nil
+	}
+	return nil, fmt.Errorf("%w: unknown preset %q", ErrInvalidConfig, name)
+}
+
+// ackWindow returns how many packets every sent packet acks
+func (c *Config) ackWindow() int {
+	if c.AckWindow == 64 && !c.ReliableIOCompatible {
+		return 64
+	}
+	return 32
+}
+
+// ErrInvalidConfig is wrapped by the errors returned from Config.Validate
+var ErrInvalidConfig = errors.New("rely: invalid config")
+
+// maxSequenceBufferSize keeps buffered sequences within the half of the sequence space that SequenceGreaterThan can order
+const maxSequenceBufferSize = 32768
+
+// Validate checks the config for values the endpoint cannot work with, and returns an error describing
+// the first one it finds
+func (c *Config) Validate() error {
+	if c.MaxPacketSize <= 0 {
+		return fmt.Errorf("%w: MaxPacketSize %d must be positive", ErrInvalidConfig, c.MaxPacketSize)
+	}
+	if c.FragmentAbove < 0 {
+		return fmt.Errorf("%w: FragmentAbove %d must not be negative", ErrInvalidConfig, c.FragmentAbove)
+	}
+	if c.FragmentSize <= 0 {
+		return fmt.Errorf("%w: FragmentSize %d must be positive", ErrInvalidConfig, c.FragmentSize)
+	}
+	if c.MaxFragments < 1 || c.MaxFragments > 256 {
+		return fmt.Errorf("%w: MaxFragments %d outside of range 1-256", ErrInvalidConfig, c.MaxFragments)
+	}
+	if c.MaxPacketSize > c.FragmentAbove && c.MaxFragments*c.FragmentSize < c.MaxPacketSize {
+		return fmt.Errorf("%w: MaxFragments %d of FragmentSize %d cannot hold MaxPacketSize %d", ErrInvalidConfig, c.MaxFragments, c.FragmentSize, c.MaxPacketSize)
+	}
+	if c.AckBufferSize <= 0 {
+		return fmt.Errorf("%w: AckBufferSize %d must be positive", ErrInvalidConfig, c.AckBufferSize)
+	}
+	// statistics are calculated over half of these buffers
+	if c.SentPacketsBufferSize < 2 || c.SentPacketsBufferSize > maxSequenceBufferSize {
+		return fmt.Errorf("%w: SentPacketsBufferSize %d outside of range 2-%d", ErrInvalidConfig, c.SentPacketsBufferSize, maxSequenceBufferSize)
+	}
+	if c.ReceivedPacketsBufferSize < 2 || c.ReceivedPacketsBufferSize > maxSequenceBufferSize {
+		return fmt.Errorf("%w: ReceivedPacketsBufferSize %d outside of range 2-%d", ErrInvalidConfig, c.ReceivedPacketsBufferSize, maxSequenceBufferSize)
+	}
+	if c.FragmentReassemblyBufferSize < 1 || c.FragmentReassemblyBufferSize > maxSequenceBufferSize {
+		return fmt.Errorf("%w: FragmentReassemblyBufferSize %d outside of range 1-%d", ErrInvalidConfig, c.FragmentReassemblyBufferSize, maxSequenceBufferSize)
+	}
+	for _, factor := range []struct {
+		name  string
+		value float64
+	}{
+		{"RttSmoothingFactor", c.RttSmoothingFactor},
+		{"PacketLossSmoothingFactor", c.PacketLossSmoothingFactor},
+		{"BandwidthSmoothingFactor", c.BandwidthSmoothingFactor},
+	} {
+		if !(factor.value > 0 && factor.value <= 1) {
+			return fmt.Errorf("%w: %s %v outside of range (0, 1]", ErrInvalidConfig, factor.name, factor.value)
+		}
+	}
+	if c.PacketHeaderSize < 0 {
+		return fmt.Errorf("%w: PacketHeaderSize %d must not be negative", ErrInvalidConfig, c.PacketHeaderSize)
+	}
+	if c.AckWindow != 0 && c.AckWindow != 32 && c.AckWindow != 64 {
+		return fmt.Errorf("%w: AckWindow %d must be 32 or 64", ErrInvalidConfig, c.AckWindow)
+	}
+	if c.KeepaliveInterval < 0 {
+		return fmt.Errorf("%w: KeepaliveInterval %v must not be negative", ErrInvalidConfig, c.KeepaliveInterval)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("%w: Timeout %v must not be negative", ErrInvalidConfig, c.Timeout)
+	}
+	if c.PlayoutDelay < 0 || c.MaxPlayoutDelay < 0 {
+		return fmt.Errorf("%w: PlayoutDelay %v and MaxPlayoutDelay %v must not be negative", ErrInvalidConfig, c.PlayoutDelay, c.MaxPlayoutDelay)
+	}
+	if c.MaxPlayoutDelay > 0 && c.MaxPlayoutDelay < c.PlayoutDelay {
+		return fmt.Errorf("%w: MaxPlayoutDelay %v is less than PlayoutDelay %v", ErrInvalidConfig, c.MaxPlayoutDelay, c.PlayoutDelay)
+	}
+	if c.MaxReorderWait < 0 {
+		return fmt.Errorf("%w: MaxReorderWait %v must not be negative", ErrInvalidConfig, c.MaxReorderWait)
+	}
+	if c.FragmentRedundancy < 0 || c.FragmentRedundancy > 1 {
+		return fmt.Errorf("%w: FragmentRedundancy %v outside of range 0-1", ErrInvalidConfig, c.FragmentRedundancy)
+	}
+	if c.RedundantPayloads < 0 || c.RedundantPayloads > maxRedundantPayloads {
+		return fmt.Errorf("%w: RedundantPayloads %d outside of range 0-%d", ErrInvalidConfig, c.RedundantPayloads, maxRedundantPayloads)
+	}
+	if c.SendBudgetKbps < 0 || c.MinSendBudgetKbps < 0 {
+		return fmt.Errorf("%w: SendBudgetKbps %v and MinSendBudgetKbps %v must not be negative", ErrInvalidConfig, c.SendBudgetKbps, c.MinSendBudgetKbps)
+	}
+	if c.CongestionAvoidance {
+		if !(c.CongestionRtt > 0) || !(c.CongestionPacketLoss > 0) {
+			return fmt.Errorf("%w: CongestionRtt %v and CongestionPacketLoss %v must be positive", ErrInvalidConfig, c.CongestionRtt, c.CongestionPacketLoss)
+		}
+		if !(c.BadSendRateKbps > 0) || c.GoodSendRateKbps < c.BadSendRateKbps {
+			return fmt.Errorf("%w: BadSendRateKbps %v must be positive and at most GoodSendRateKbps %v", ErrInvalidConfig, c.BadSendRateKbps, c.GoodSendRateKbps)
+		}
+	}
+	if c.CongestionAvoidance && c.CongestionController != nil {
+		return fmt.Errorf("%w: CongestionAvoidance cannot be combined with a CongestionController", ErrInvalidConfig)
+	}
+	if c.JitterBuffer && c.OrderedDelivery {
+		return fmt.Errorf("%w: JitterBuffer already delivers in order, it cannot be combined with OrderedDelivery", ErrInvalidConfig)
+	}
+	if c.ReliableIOCompatible {
+		if c.ProtocolId != 0 || c.ProtocolVersion != 0 || c.Checksum || c.AckWindow == 64 || c.FragmentRedundancy > 0 || c.RedundantPayloads > 0 || c.Compressor != nil {
+			return fmt.Errorf("%w: ReliableIOCompatible cannot be combined with ProtocolId, ProtocolVersion, Checksum, FragmentRedundancy, RedundantPayloads, Compressor or a 64 packet AckWindow", ErrInvalidConfig)
+		}
+	}
+	if c.TransmitPacketFunction == nil {
+		return fmt.Errorf("%w: TransmitPacketFunction is required", ErrInvalidConfig)
+	}
+	if c.ProcessPacketFunction == nil {
+		return fmt.Errorf("%w: ProcessPacketFunction is required", ErrInvalidConfig)
+	}
+	if (c.Allocate == nil) != (c.Free == nil) {
+		return fmt.Errorf("%w: Allocate and Free must be set together", ErrInvalidConfig)
 	}
+	return nil
 }
@@ -0,0 +1,111 @@
+package rely
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConfig_Validate(t *testing.T) {
+	valid := func() *Config {
+		config := NewDefaultConfig()
+		config.TransmitPacketFunction = testTransmitPacketFunction
+		config.ProcessPacketFunction = testProcessPacketFunction
+		return config
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Fatal("Default config should be valid", err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(config *Config)
+	}{
+		{"zero sent buffer", func(c *Config) { c.SentPacketsBufferSize = 0 }},
+		{"zero received buffer", func(c *Config) { c.ReceivedPacketsBufferSize = 0 }},
+		{"zero reassembly buffer", func(c *Config) { c.FragmentReassemblyBufferSize = 0 }},
+		{"huge sent buffer", func(c *Config) { c.SentPacketsBufferSize = 40000 }},
+		{"zero ack buffer", func(c *Config) { c.AckBufferSize = 0 }},
+		{"too many fragments", func(c *Config) { c.MaxFragments = 257 }},
+		{"no fragments", func(c *Config) { c.MaxFragments = 0 }},
+		{"zero fragment size", func(c *Config) { c.FragmentSize = 0 }},
+		{"fragments too small", func(c *Config) { c.MaxFragments = 4 }},
+		{"zero max packet size", func(c *Config) { c.MaxPacketSize = 0 }},
+		{"negative fragment above", func(c *Config) { c.FragmentAbove = -1 }},
+		{"zero rtt smoothing", func(c *Config) { c.RttSmoothingFactor = 0 }},
+		{"large loss smoothing", func(c *Config) { c.PacketLossSmoothingFactor = 1.5 }},
+		{"negative bandwidth smoothing", func(c *Config) { c.BandwidthSmoothingFactor = -.1 }},
+		{"negative header size", func(c *Config) { c.PacketHeaderSize = -1 }},
+		{"odd ack window", func(c *Config) { c.AckWindow = 48 }},
+		{"negative keepalive", func(c *Config) { c.KeepaliveInterval = -1 }},
+		{"negative timeout", func(c *Config) { c.Timeout = -1 }},
+		{"negative playout delay", func(c *Config) { c.PlayoutDelay = -1 }},
+		{"max playout delay too small", func(c *Config) { c.PlayoutDelay, c.MaxPlayoutDelay = .1, .05 }},
+		{"negative reorder wait", func(c *Config) { c.MaxReorderWait = -1 }},
+		{"jitter buffer and ordered", func(c *Config) { c.JitterBuffer, c.OrderedDelivery = true, true }},
+		{"redundancy above 1", func(c *Config) { c.FragmentRedundancy = 1.5 }},
+		{"compatible with redundancy", func(c *Config) { c.ReliableIOCompatible, c.FragmentRedundancy = true, .25 }},
+		{"too many redundant payloads", func(c *Config) { c.RedundantPayloads = 256 }},
+		{"compatible with redundant payloads", func(c *Config) { c.ReliableIOCompatible, c.RedundantPayloads = true, 2 }},
+		{"compatible with compressor", func(c *Config) { c.ReliableIOCompatible, c.Compressor = true, &FlateCompressor{} }},
+		{"negative send budget", func(c *Config) { c.SendBudgetKbps = -1 }},
+		{"no bad send rate", func(c *Config) { c.CongestionAvoidance, c.BadSendRateKbps = true, 0 }},
+		{"bad send rate above good", func(c *Config) { c.CongestionAvoidance, c.BadSendRateKbps = true, 512 }},
+		{"no congestion rtt", func(c *Config) { c.CongestionAvoidance, c.CongestionRtt = true, 0 }},
+		{"congestion avoidance and controller", func(c *Config) { c.CongestionAvoidance, c.CongestionController = true, NewAIMDController() }},
+		{"compatible with checksum", func(c *Config) { c.ReliableIOCompatible, c.Checksum = true, true }},
+		{"compatible with protocol", func(c *Config) { c.ReliableIOCompatible, c.ProtocolId = true, 1 }},
+		{"compatible with wide acks", func(c *Config) { c.ReliableIOCompatible, c.AckWindow = true, 64 }},
+		{"no transmit", func(c *Config) { c.TransmitPacketFunction = nil }},
+		{"no process", func(c *Config) { c.ProcessPacketFunction = nil }},
+		{"allocate without free", func(c *Config) { c.Allocate = defaultAllocate }},
+	}
+
+	for _, test := range tests {
+		config := valid()
+		test.configure(config)
+		err := config.Validate()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Error(test.name, "should be invalid, got", err)
+		}
+		if endpoint, err := NewValidatedEndpoint(config, 0); endpoint != nil || err == nil {
+			t.Error(test.name, "should not create an endpoint")
+		}
+	}
+
+	// fragments only have to hold packets that get fragmented
+	config := valid()
+	config.MaxFragments = 4
+	config.FragmentAbove = config.MaxPacketSize
+	if err := config.Validate(); err != nil {
+		t.Error("Unfragmented config should be valid", err)
+	}
+	if endpoint, err := NewValidatedEndpoint(config, 0); endpoint == nil || err != nil {
+		t.Error("Expected an endpoint", err)
+	}
+
+	// the zero value of the minimum send budget is valid
+	config = valid()
+	config.MinSendBudgetKbps = 0
+	if err := config.Validate(); err != nil {
+		t.Error("Config without a minimum send budget should be valid", err)
+	}
+}
+
+func TestConfig_Presets(t *testing.T) {
+	for _, name := range []string{"default", "lan", "wan", "mobile", "high-rate", "large-payload"} {
+		config, err := NewPresetConfig(name)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		config.TransmitPacketFunction = testTransmitPacketFunction
+		config.ProcessPacketFunction = testProcessPacketFunction
+		if err := config.Validate(); err != nil {
+			t.Error(name, "preset is invalid", err)
+		}
+	}
+
+	if _, err := NewPresetConfig("satellite"); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Expected unknown preset error", err)
+	}
+}
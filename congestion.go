@@ -0,0 +1,104 @@
+package rely
+
+import (
+	"math"
+)
+
+// Congestion avoidance switches between a good and a bad send rate, as described in
+// https://gafferongames.com/post/reliability_ordering_and_congestion_avoidance_over_udp/. The endpoint drops to
+// the bad rate as soon as RTT or packet loss go over their thresholds, and goes back to the good rate once
+// conditions have been good for the penalty time. The penalty time doubles when conditions turn bad again
+// soon after going back, and halves for every while they stay good, so that a link that keeps flapping
+// settles on the bad rate.
+const (
+	congestionInitialPenalty = 4
+	congestionMinPenalty     = 1
+	congestionMaxPenalty     = 60
+	// congestionGoodTime is how many seconds of good conditions halve the penalty, and how soon after going
+	// back to the good rate bad conditions double it
+	congestionGoodTime = 10
+)
+
+// congestionAvoidance is the state of the good and bad mode switching
+type congestionAvoidance struct {
+	bad bool
+	// penalty is how many seconds conditions must be good for in bad mode to go back to good mode
+	penalty float64
+	// goodTime is how long conditions have been good for
+	goodTime float64
+	// reductionTime is how long conditions have been good for since the penalty was last halved
+	reductionTime float64
+	lastUpdate    float64
+}
+
+func newCongestionAvoidance(time float64) congestionAvoidance {
+	return congestionAvoidance{penalty: congestionInitialPenalty, lastUpdate: time}
+}
+
+// update switches modes for the conditions at the time
+func (c *congestionAvoidance) update(time float64, good bool) (switched bool) {
+	dt := math.Max(time-c.lastUpdate, 0)
+	c.lastUpdate = time
+
+	if !c.bad {
+		if !good {
+			if c.goodTime < congestionGoodTime {
+				c.penalty = math.Min(c.penalty*2, congestionMaxPenalty)
+			}
+			c.bad = true
+			c.goodTime = 0
+			c.reductionTime = 0
+			return true
+		}
+		c.goodTime += dt
+		c.reductionTime += dt
+		if c.reductionTime > congestionGoodTime {
+			c.penalty = math.Max(c.penalty/2, congestionMinPenalty)
+			c.reductionTime = 0
+		}
+		return false
+	}
+
+	if good {
+		c.goodTime += dt
+	} else {
+		c.goodTime = 0
+	}
+	if c.goodTime > c.penalty {
+		c.bad = false
+		c.goodTime = 0
+		c.reductionTime = 0
+		return true
+	}
+	return false
+}
+
+// updateCongestion switches between the good and bad send rates when Config.CongestionAvoidance is set
+func (e *Endpoint) updateCongestion() {
+	if !e.config.CongestionAvoidance {
+		return
+	}
+	good := e.rtt <= e.config.CongestionRtt && e.packetLoss <= e.config.CongestionPacketLoss
+	if e.congestion.update(e.time, good) {
+		if e.congestion.bad {
+			log.Warningf("[%s] congested, rtt %.1fms packet loss %.1f%%. sending at %vkbps for at least %v seconds", e.config.Name, e.rtt, e.packetLoss, e.config.BadSendRateKbps, e.congestion.penalty)
+		} else {
+			debugf("[%s] no longer congested. sending at %vkbps", e.config.Name, e.config.GoodSendRateKbps)
+		}
+	}
+}
+
+// Congested reports whether the endpoint is sending at the bad send rate, see Config.CongestionAvoidance
+func (e *Endpoint) Congested() bool {
+	return e.config.CongestionAvoidance && e.congestion.bad
+}
+
+// RecommendedSendRate returns the rate in Kbps to send at, which is Config.BadSendRateKbps while congested
+// and Config.GoodSendRateKbps otherwise. The send queue keeps to it, and applications that send from
+// elsewhere can scale their update rate or detail by it.
+func (e *Endpoint) RecommendedSendRate() float64 {
+	if e.Congested() {
+		return e.config.BadSendRateKbps
+	}
+	return e.config.GoodSendRateKbps
+}
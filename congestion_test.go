@@ -0,0 +1,83 @@
+package rely
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestCongestionAvoidance_Modes(t *testing.T) {
+	c := newCongestionAvoidance(0)
+
+	// bad conditions switch right away, and soon after starting that doubles the penalty
+	if c.update(1, true) || !c.update(2, false) || !c.bad || c.penalty != 8 {
+		t.Fatal("Expected bad mode with a penalty of 8, got", c)
+	}
+	// conditions must stay good for the whole penalty
+	c.update(6, true)
+	c.update(7, false)
+	c.update(14, true)
+	if !c.bad {
+		t.Fatal("Expected bad mode until conditions are good for the penalty, got", c)
+	}
+	if !c.update(16, true) || c.bad {
+		t.Fatal("Expected good mode after the penalty, got", c)
+	}
+
+	// going bad again soon doubles the penalty up to the max
+	for i := 0; i < 10; i++ {
+		c.update(c.lastUpdate+1, false)
+		c.update(c.lastUpdate+c.penalty+1, true)
+	}
+	if c.penalty != congestionMaxPenalty {
+		t.Error("Expected the max penalty, got", c.penalty)
+	}
+
+	// staying good halves it down to the min
+	for i := 0; i < 20; i++ {
+		c.update(c.lastUpdate+congestionGoodTime+1, true)
+	}
+	if c.bad || c.penalty != congestionMinPenalty {
+		t.Error("Expected good mode with the min penalty, got", c)
+	}
+	// and going bad after a long good stretch keeps it
+	c.update(c.lastUpdate+1, false)
+	if !c.bad || c.penalty != congestionMinPenalty {
+		t.Error("Expected the penalty to stay at the min, got", c)
+	}
+}
+
+func TestCongestionAvoidance(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.CongestionAvoidance = true
+	})
+	sender := context.sender
+
+	if sender.Congested() || sender.RecommendedSendRate() != 256 || sender.sendBudget() != 256*1000/8 {
+		t.Fatal("Expected the good send rate", sender.RecommendedSendRate(), sender.sendBudget())
+	}
+
+	sender.rtt = 300
+	sender.Update(101)
+	if !sender.Congested() || sender.RecommendedSendRate() != 64 || sender.sendBudget() != 64*1000/8 {
+		t.Fatal("Expected the bad send rate for high RTT", sender.RecommendedSendRate(), sender.sendBudget())
+	}
+
+	sender.rtt = 50
+	for time := 102.; time <= 110; time++ {
+		sender.Update(time)
+	}
+	if sender.Congested() {
+		t.Error("Expected the good send rate once the RTT is back down")
+	}
+
+	sender.config.CongestionAvoidance = false
+	sender.rtt = 300
+	sender.Update(111)
+	if sender.Congested() || sender.RecommendedSendRate() != 256 {
+		t.Error("Expected no congestion avoidance when disabled")
+	}
+}
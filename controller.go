@@ -0,0 +1,312 @@
+package rely
+
+import (
+	"math"
+)
+
+// CongestionController decides how much an endpoint may send, see Config.CongestionController. It is told
+// about every packet the endpoint sends, and whether it was acked or lost. A packet is lost when three
+// packets sent after it are acked first, or when it goes unacked for twice the RTT. Each endpoint needs
+// its own controller.
+type CongestionController interface {
+	// OnPacketSent is called by SendPacket with the bytes of a packet, including Config.PacketHeaderSize
+	OnPacketSent(time float64, bytes int)
+	// OnPacketAcked is called by ReceivePacket when a packet is acked, with the RTT of the packet in milliseconds
+	OnPacketAcked(time float64, bytes int, rtt float64)
+	// OnPacketLost is called when a packet is found to be lost
+	OnPacketLost(time float64, bytes int)
+	// Window returns the most bytes that may be sent but not yet acked or lost
+	Window() int
+	// PacingRate returns the rate in Kbps to send at
+	PacingRate() float64
+}
+
+const (
+	// congestionSegmentBytes is the packet size windows are grown by
+	congestionSegmentBytes  = 1200
+	congestionInitialWindow = 10 * congestionSegmentBytes
+	congestionMinWindow     = 2 * congestionSegmentBytes
+	congestionMaxWindow     = 1 << 24
+	// congestionInitialRtt is assumed in milliseconds until a packet is acked
+	congestionInitialRtt = 100
+	// congestionPacingGain paces a little faster than the window per RTT so that sending keeps up with acks
+	congestionPacingGain = 1.25
+	// congestionLossPackets is how many later packets must be acked for a packet to be lost
+	congestionLossPackets = 3
+	// congestionMinLossTimeout is the least seconds a packet goes unacked for before it is lost
+	congestionMinLossTimeout = .1
+)
+
+// congestionWindow is the window and RTT tracking shared by the controllers
+type congestionWindow struct {
+	window       float64
+	inFlight     int
+	rtt          float64
+	hasRtt       bool
+	lastDecrease float64
+}
+
+func newCongestionWindow() congestionWindow {
+	return congestionWindow{window: congestionInitialWindow, rtt: congestionInitialRtt, lastDecrease: math.Inf(-1)}
+}
+
+func (w *congestionWindow) sent(bytes int) {
+	w.inFlight += bytes
+}
+
+// acked records an ack and returns true if the window was in use, so that growing it is warranted
+func (w *congestionWindow) acked(bytes int, rtt float64) bool {
+	limited := float64(w.inFlight) >= w.window/2
+	w.inFlight = max0(w.inFlight - bytes)
+	if w.hasRtt {
+		w.rtt += (rtt - w.rtt) / 8
+	} else {
+		w.rtt, w.hasRtt = rtt, true
+	}
+	return limited
+}
+
+// lost records a loss and returns true if the window was decreased, at most once per RTT
+func (w *congestionWindow) lost(time float64, bytes int, factor float64) bool {
+	w.inFlight = max0(w.inFlight - bytes)
+	if time-w.lastDecrease < w.rtt/1000 {
+		return false
+	}
+	w.lastDecrease = time
+	w.window = math.Max(w.window*factor, congestionMinWindow)
+	return true
+}
+
+func (w *congestionWindow) grow(bytes float64) {
+	w.window = math.Min(math.Max(w.window+bytes, congestionMinWindow), congestionMaxWindow)
+}
+
+// Window implements CongestionController
+func (w *congestionWindow) Window() int {
+	return int(w.window)
+}
+
+// PacingRate implements CongestionController
+func (w *congestionWindow) PacingRate() float64 {
+	return congestionPacingGain * w.window * 8 / math.Max(w.rtt, 1)
+}
+
+func max0(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// AIMDController grows the window by a packet every RTT and halves it on loss, like TCP Reno. Until the
+// first loss it doubles the window every RTT instead, to find the available bandwidth quickly.
+type AIMDController struct {
+	congestionWindow
+	slowStart bool
+}
+
+// NewAIMDController creates an AIMD controller
+func NewAIMDController() *AIMDController {
+	return &AIMDController{congestionWindow: newCongestionWindow(), slowStart: true}
+}
+
+// OnPacketSent implements CongestionController
+func (c *AIMDController) OnPacketSent(_ float64, bytes int) {
+	c.sent(bytes)
+}
+
+// OnPacketAcked implements CongestionController
+func (c *AIMDController) OnPacketAcked(_ float64, bytes int, rtt float64) {
+	if !c.acked(bytes, rtt) {
+		return
+	}
+	if c.slowStart {
+		c.grow(float64(bytes))
+	} else {
+		c.grow(congestionSegmentBytes * float64(bytes) / c.window)
+	}
+}
+
+// OnPacketLost implements CongestionController
+func (c *AIMDController) OnPacketLost(time float64, bytes int) {
+	if c.lost(time, bytes, .5) {
+		c.slowStart = false
+	}
+}
+
+const (
+	// ledbatBaseHistory is how many minutes the lowest RTT is kept for
+	ledbatBaseHistory = 10
+	// ledbatCurrentSamples is how many RTT samples the current delay is the lowest of, to filter out noise
+	ledbatCurrentSamples = 4
+	ledbatDefaultTarget  = 100
+)
+
+// LEDBATController is a delay based controller after LEDBAT (RFC 6817). It keeps the queuing delay it adds
+// to the link at a target, measured as the RTT above the lowest RTT seen, growing the window while under the
+// target and shrinking it while over. Loss based controllers fill the queue until packets are dropped, so
+// they win against it: this makes it suited to bulk transfers, like downloads, that should give way to
+// latency sensitive traffic on the same link. It measures RTT rather than one way delay, so queuing in
+// either direction counts.
+type LEDBATController struct {
+	congestionWindow
+	target       float64
+	baseDelays   [ledbatBaseHistory]float64
+	baseMinute   int64
+	current      [ledbatCurrentSamples]float64
+	currentIndex int
+}
+
+// NewLEDBATController creates a LEDBAT controller that targets the queuing delay in milliseconds, 100 if it
+// is not positive. RFC 6817 targets 100 milliseconds of one way delay at most.
+func NewLEDBATController(target float64) *LEDBATController {
+	if target <= 0 {
+		target = ledbatDefaultTarget
+	}
+	c := &LEDBATController{congestionWindow: newCongestionWindow(), target: target, baseMinute: -1}
+	for i := range c.baseDelays {
+		c.baseDelays[i] = math.Inf(1)
+	}
+	for i := range c.current {
+		c.current[i] = math.Inf(1)
+	}
+	return c
+}
+
+// OnPacketSent implements CongestionController
+func (c *LEDBATController) OnPacketSent(_ float64, bytes int) {
+	c.sent(bytes)
+}
+
+// OnPacketAcked implements CongestionController
+func (c *LEDBATController) OnPacketAcked(time float64, bytes int, rtt float64) {
+	limited := c.acked(bytes, rtt)
+
+	if minute := int64(time / 60); minute != c.baseMinute {
+		// start a new minute, forgetting the oldest
+		copy(c.baseDelays[1:], c.baseDelays[:ledbatBaseHistory-1])
+		c.baseDelays[0] = rtt
+		c.baseMinute = minute
+	}
+	c.baseDelays[0] = math.Min(c.baseDelays[0], rtt)
+	c.current[c.currentIndex] = rtt
+	c.currentIndex = (c.currentIndex + 1) % ledbatCurrentSamples
+
+	offTarget := (c.target - c.QueuingDelay()) / c.target
+	if offTarget > 0 && !limited {
+		return
+	}
+	c.grow(offTarget * congestionSegmentBytes * float64(bytes) / c.window)
+}
+
+// OnPacketLost implements CongestionController
+func (c *LEDBATController) OnPacketLost(time float64, bytes int) {
+	c.lost(time, bytes, .5)
+}
+
+// QueuingDelay returns the milliseconds the current RTT is above the lowest RTT of the last ten minutes
+func (c *LEDBATController) QueuingDelay() float64 {
+	base, current := math.Inf(1), math.Inf(1)
+	for _, delay := range c.baseDelays {
+		base = math.Min(base, delay)
+	}
+	for _, delay := range c.current {
+		current = math.Min(current, delay)
+	}
+	if math.IsInf(base, 1) || math.IsInf(current, 1) {
+		return 0
+	}
+	return current - base
+}
+
+// trackInFlight counts a sent packet as in flight for the congestion controller
+func (e *Endpoint) trackInFlight(sentPacketData *sentPacketData) {
+	sentPacketData.InFlight = true
+	e.bytesInFlight += int(sentPacketData.PacketBytes)
+	e.config.CongestionController.OnPacketSent(e.time, int(sentPacketData.PacketBytes))
+}
+
+// ackInFlight tells the congestion controller a packet in flight was acked
+func (e *Endpoint) ackInFlight(sequence uint16, sentPacketData *sentPacketData, rtt float64) {
+	if !sentPacketData.InFlight {
+		return
+	}
+	sentPacketData.InFlight = false
+	e.bytesInFlight -= int(sentPacketData.PacketBytes)
+	e.config.CongestionController.OnPacketAcked(e.time, int(sentPacketData.PacketBytes), rtt)
+	if !e.hasLargestAcked || SequenceGreaterThan(sequence, e.largestAcked) {
+		e.largestAcked = sequence
+		e.hasLargestAcked = true
+	}
+}
+
+// lossTimeout returns how many seconds a packet goes unacked for before it is lost
+func (e *Endpoint) lossTimeout() float64 {
+	if e.rtt == 0 {
+		return 1
+	}
+	return math.Max(2*e.rtt/1000, congestionMinLossTimeout)
+}
+
+// detectLosses tells the congestion controller about the packets in flight that are lost: the ones before
+// the sequence, and the ones sent before the time. Packets are checked in the order they were sent, so
+// it stops at the first packet in flight that is neither.
+func (e *Endpoint) detectLosses(before uint16, sentBefore float64) {
+	if start := e.sentPackets.Sequence - uint16(e.sentPackets.NumEntries); SequenceLessThan(e.lossSequence, start) {
+		// the packets in between are gone from the buffer, and were lost when they left it
+		e.lossSequence = start
+	}
+	for ; SequenceLessThan(e.lossSequence, e.sentPackets.Sequence); e.lossSequence++ {
+		sentPacketData := e.sentPackets.Find(e.lossSequence)
+		if sentPacketData == nil || !sentPacketData.InFlight {
+			continue
+		}
+		if !SequenceLessThan(e.lossSequence, before) && sentPacketData.Time >= sentBefore {
+			break
+		}
+		debugf("[%s] lost packet %d", e.config.Name, e.lossSequence)
+		sentPacketData.InFlight = false
+		e.bytesInFlight -= int(sentPacketData.PacketBytes)
+		e.counters[counterNumPacketsLost]++
+		e.config.CongestionController.OnPacketLost(e.time, int(sentPacketData.PacketBytes))
+	}
+}
+
+// detectAckedLosses finds the packets lost by the latest acks
+func (e *Endpoint) detectAckedLosses() {
+	if e.hasLargestAcked {
+		e.detectLosses(e.largestAcked-congestionLossPackets+1, e.time-e.lossTimeout())
+	}
+}
+
+// resetInFlight forgets the packets in flight, telling the congestion controller they were lost since they
+// can no longer be acked
+func (e *Endpoint) resetInFlight() {
+	for i := 0; i < e.sentPackets.NumEntries; i++ {
+		if sentPacketData := e.sentPackets.AtIndex(i); sentPacketData != nil && sentPacketData.InFlight {
+			sentPacketData.InFlight = false
+			e.config.CongestionController.OnPacketLost(e.time, int(sentPacketData.PacketBytes))
+		}
+	}
+	e.bytesInFlight = 0
+	e.lossSequence = 0
+	e.largestAcked = 0
+	e.hasLargestAcked = false
+}
+
+// congestionWindowOpen returns true if the congestion controller allows sending more
+func (e *Endpoint) congestionWindowOpen() bool {
+	return e.config.CongestionController == nil || e.bytesInFlight < e.config.CongestionController.Window()
+}
+
+// BytesInFlight returns the bytes of the packets sent but not yet acked or lost, while a
+// Config.CongestionController is set. Applications sending with SendPacket should hold off while it is at
+// the window of the controller.
+func (e *Endpoint) BytesInFlight() int {
+	return e.bytesInFlight
+}
+
+// PacketsLost returns the number of packets found to be lost while a Config.CongestionController is set
+func (e *Endpoint) PacketsLost() uint64 {
+	return e.counters[counterNumPacketsLost]
+}
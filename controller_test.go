@@ -0,0 +1,189 @@
+package rely
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestAIMDController(t *testing.T) {
+	c := NewAIMDController()
+	c.OnPacketSent(0, congestionInitialWindow)
+
+	// slow start doubles the window every RTT while it is in use
+	for i := 0; i < 10; i++ {
+		c.OnPacketAcked(.1, congestionSegmentBytes, 100)
+		c.OnPacketSent(.1, congestionSegmentBytes)
+	}
+	if c.Window() != 2*congestionInitialWindow {
+		t.Fatal("Expected the window to double, got", c.Window())
+	}
+
+	// loss halves it at most once per RTT
+	c.OnPacketLost(1, congestionSegmentBytes)
+	c.OnPacketLost(1.05, congestionSegmentBytes)
+	if c.Window() != congestionInitialWindow {
+		t.Fatal("Expected the window to halve once, got", c.Window())
+	}
+	c.OnPacketLost(1.2, congestionSegmentBytes)
+	if c.Window() != congestionInitialWindow/2 {
+		t.Fatal("Expected the window to halve again, got", c.Window())
+	}
+
+	// and after a loss it grows by a packet every RTT
+	c.OnPacketAcked(1.3, congestionSegmentBytes, 100)
+	if c.Window() != 6240 || c.PacingRate() != 624 {
+		t.Error("Expected additive increase, got", c.Window(), c.PacingRate())
+	}
+
+	// the window is not grown while it is not in use
+	c.OnPacketAcked(1.3, 8000, 100)
+	window := c.Window()
+	c.OnPacketAcked(1.3, congestionSegmentBytes, 100)
+	if c.Window() != window {
+		t.Error("Expected the window to stay when not in use, got", c.Window())
+	}
+}
+
+func TestLEDBATController(t *testing.T) {
+	c := NewLEDBATController(0)
+	c.OnPacketSent(0, congestionInitialWindow)
+
+	// under the target the window grows
+	c.OnPacketAcked(0, congestionSegmentBytes, 50)
+	if c.Window() != congestionInitialWindow+120 {
+		t.Fatal("Expected the window to grow, got", c.Window())
+	}
+
+	// over the target it shrinks, once the RTT stays up
+	for i := 0; i < ledbatCurrentSamples-1; i++ {
+		c.OnPacketAcked(1, congestionSegmentBytes, 300)
+	}
+	window := c.Window()
+	c.OnPacketAcked(1, congestionSegmentBytes, 300)
+	if c.QueuingDelay() != 250 || c.Window() >= window {
+		t.Error("Expected the window to shrink for 250ms of queuing delay, got", c.QueuingDelay(), window, c.Window())
+	}
+
+	// the lowest RTT is forgotten after ten minutes
+	for minute := 1; minute <= ledbatBaseHistory; minute++ {
+		c.OnPacketAcked(float64(minute*60), congestionSegmentBytes, 300)
+	}
+	if c.QueuingDelay() != 0 {
+		t.Error("Expected the base delay to follow the RTT, got", c.QueuingDelay())
+	}
+
+	if c := NewLEDBATController(25); c.target != 25 {
+		t.Error("Expected the target to be kept, got", c.target)
+	}
+}
+
+// testController has a fixed window
+type testController struct {
+	window        int
+	sent, acked   int
+	lost          int
+	lastLostBytes int
+}
+
+func (c *testController) OnPacketSent(_ float64, _ int)             { c.sent++ }
+func (c *testController) OnPacketAcked(_ float64, _ int, _ float64) { c.acked++ }
+func (c *testController) OnPacketLost(_ float64, bytes int) {
+	c.lost++
+	c.lastLostBytes = bytes
+}
+func (c *testController) Window() int         { return c.window }
+func (c *testController) PacingRate() float64 { return 10000 }
+
+func TestCongestionController(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.CongestionController = &testController{window: 300}
+	})
+	sender, receiver := context.sender, context.receiver
+	controller := sender.config.CongestionController.(*testController)
+
+	// packet 1 is lost once packets 2 to 4 are acked
+	for i := 0; i < 6; i++ {
+		context.drop = 0
+		if i == 1 {
+			context.drop = 1
+		}
+		sender.SendPacket(make([]byte, 100))
+	}
+	context.drop = 0
+	if controller.sent != 6 || sender.BytesInFlight() != 6*128 {
+		t.Fatal("Expected 6 packets in flight, got", controller.sent, sender.BytesInFlight())
+	}
+	receiver.SendPacket(nil)
+	if controller.acked != 5 || controller.lost != 1 || controller.lastLostBytes != 128 || sender.PacketsLost() != 1 || sender.BytesInFlight() != 0 {
+		t.Fatal("Expected 5 packets acked and 1 lost, got", controller.acked, controller.lost, sender.PacketsLost(), sender.BytesInFlight())
+	}
+
+	// unacked packets are lost after a while
+	context.drop = 1
+	sender.SendPacket(make([]byte, 100))
+	sender.Update(100.5)
+	if controller.lost != 1 {
+		t.Error("Expected the packet to be in flight still")
+	}
+	sender.Update(101.5)
+	if controller.lost != 2 || sender.BytesInFlight() != 0 {
+		t.Error("Expected the packet to be lost after a while, got", controller.lost, sender.BytesInFlight())
+	}
+
+	// the send queue keeps to the window
+	context.drop = 0
+	for i := 0; i < 5; i++ {
+		sender.QueuePacket(make([]byte, 100), 0, 0)
+	}
+	sender.Update(102)
+	if sender.QueuedPackets() != 2 || sender.BytesInFlight() != 3*128 {
+		t.Error("Expected 3 packets to fit the window, got", sender.QueuedPackets(), sender.BytesInFlight())
+	}
+	receiver.SendPacket(nil)
+	sender.Update(102.1)
+	if sender.QueuedPackets() != 0 {
+		t.Error("Expected the rest to be sent once acked, got", sender.QueuedPackets())
+	}
+
+	sender.Reset()
+	if sender.BytesInFlight() != 0 {
+		t.Error("Reset did not forget the packets in flight", sender.BytesInFlight())
+	}
+}
+
+func TestCongestionController_Reset(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.CongestionController = NewAIMDController()
+	})
+	sender, receiver := context.sender, context.receiver
+	controller := sender.config.CongestionController.(*AIMDController)
+
+	// a window's worth of packets is in flight when the endpoints are reset
+	context.drop = 1
+	for i := 0; i < 10; i++ {
+		sender.SendPacket(make([]byte, 1000))
+	}
+	context.drop = 0
+	sender.Reset()
+	receiver.Reset()
+	if controller.inFlight != 0 {
+		t.Fatal("Expected the controller to be told the packets are gone, got", controller.inFlight)
+	}
+
+	// so sending little does not grow the window
+	window := controller.Window()
+	for i := 0; i < 20; i++ {
+		sender.SendPacket(make([]byte, 100))
+		receiver.SendPacket(nil)
+	}
+	if controller.Window() != window || sender.BytesInFlight() != 0 {
+		t.Error("Expected the window to stay while not in use, got", window, controller.Window(), sender.BytesInFlight())
+	}
+}
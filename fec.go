@@ -0,0 +1,266 @@
+package rely
+
+import (
+	"fmt"
+	"math"
+)
+
+// Parity fragments let the receiver rebuild lost fragments of a packet. The fragments of a packet are
+// dealt out to groups in turn, fragment i going to group i % numGroups, and each group gets a parity
+// fragment that is the XOR of its fragments padded to the fragment size. Any one missing fragment of a
+// group can be rebuilt from the parity and the rest of the group, so up to numGroups fragments can be
+// lost, including any numGroups in a row.
+//
+// The parity fragment header:
+//
+//	[prefix byte 0x03] [sequence (uint16)] [group (uint8)] [num fragments - 1 (uint8)] [num groups - 1 (uint8)]
+//	[packet bytes (uint32)] [packet header]
+//
+// The packet header and size are repeated so that the first and last fragments can be rebuilt too.
+const (
+	prefixParity      = 0x03
+	parityHeaderBytes = 10
+)
+
+// parityHeader is written in front of every parity fragment
+type parityHeader struct {
+	Sequence     uint16
+	Group        int
+	NumFragments int
+	NumGroups    int
+	PacketBytes  int
+	Packet       PacketHeader
+}
+
+// isParity reports whether the datagram is a parity fragment, judging by its prefix byte
+func isParity(packetData []byte) bool {
+	return len(packetData) > 0 && packetData[0] == prefixParity
+}
+
+// fragmentRedundancy returns the parity fragments to send per fragment, none when keeping to the reliable.io wire format
+func (c *Config) fragmentRedundancy() float64 {
+	if c.ReliableIOCompatible {
+		return 0
+	}
+	return c.FragmentRedundancy
+}
+
+// parityGroups returns how many parity fragments to send for a packet of numFragments
+func parityGroups(numFragments int, redundancy float64) int {
+	if redundancy <= 0 {
+		return 0
+	}
+	numGroups := int(math.Ceil(float64(numFragments) * redundancy))
+	if numGroups > numFragments {
+		numGroups = numFragments
+	}
+	return numGroups
+}
+
+func (h *parityHeader) Marshal(data []byte) (int, error) {
+	if len(data) < parityHeaderBytes+h.Packet.Size() {
+		return 0, ErrShortBuffer
+	}
+	p := buffer{buf: data}
+	p.writeUint8(prefixParity)
+	p.writeUint16(h.Sequence)
+	p.writeUint8(uint8(h.Group))
+	p.writeUint8(uint8(h.NumFragments - 1))
+	p.writeUint8(uint8(h.NumGroups - 1))
+	p.writeUint32(uint32(h.PacketBytes))
+	n, err := h.Packet.Marshal(data[p.pos:])
+	if err != nil {
+		return 0, err
+	}
+	return p.pos + n, nil
+}
+
+func (h *parityHeader) Unmarshal(data []byte) (int, error) {
+	if len(data) < parityHeaderBytes {
+		return 0, ErrPacketTooSmall
+	}
+	p := buffer{buf: data}
+	prefixByte, _ := p.getUint8()
+	if prefixByte != prefixParity {
+		return 0, ErrNotFragment
+	}
+	h.Sequence, _ = p.getUint16()
+	tmp, _ := p.getUint8()
+	h.Group = int(tmp)
+	tmp, _ = p.getUint8()
+	h.NumFragments = int(tmp) + 1
+	tmp, _ = p.getUint8()
+	h.NumGroups = int(tmp) + 1
+	packetBytes, _ := p.getUint32()
+	h.PacketBytes = int(packetBytes)
+
+	if h.NumGroups > h.NumFragments || h.Group >= h.NumGroups {
+		return 0, fmt.Errorf("%w: parity group %d of %d outside of range of num fragments %d", ErrInvalidFragment, h.Group, h.NumGroups, h.NumFragments)
+	}
+	n, err := h.Packet.Unmarshal(data[p.pos:])
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad packet header in parity fragment: %v", ErrInvalidFragment, err)
+	}
+	if h.Packet.Sequence != h.Sequence {
+		return 0, fmt.Errorf("%w: bad packet sequence in parity fragment. expected %d, got %d", ErrInvalidFragment, h.Sequence, h.Packet.Sequence)
+	}
+	return p.pos + n, nil
+}
+
+// sendParityFragments sends the parity fragments of a fragmented packet, using the transmit buffer
+func (e *Endpoint) sendParityFragments(header PacketHeader, packetData, transmitPacketData []byte, numFragments int) {
+	numGroups := parityGroups(numFragments, e.config.fragmentRedundancy())
+	fragmentSize := e.config.FragmentSize
+	parity := parityHeader{
+		Sequence:     header.Sequence,
+		NumFragments: numFragments,
+		NumGroups:    numGroups,
+		PacketBytes:  len(packetData),
+		Packet:       header,
+	}
+	for group := 0; group < numGroups; group++ {
+		parity.Group = group
+		headerBytes, _ := parity.Marshal(transmitPacketData)
+		xor := transmitPacketData[headerBytes : headerBytes+fragmentSize]
+		for i := range xor {
+			xor[i] = 0
+		}
+		for fragmentId := group; fragmentId < numFragments; fragmentId += numGroups {
+			fragment := packetData[fragmentId*fragmentSize:]
+			if len(fragment) > fragmentSize {
+				fragment = fragment[:fragmentSize]
+			}
+			for i, b := range fragment {
+				xor[i] ^= b
+			}
+		}
+		e.transmitPacket(header.Sequence, transmitPacketData[:headerBytes+fragmentSize])
+		e.counters[counterNumFragmentsSent]++
+	}
+}
+
+// receiveParityFragment stores a parity fragment and rebuilds the missing fragment of its group if it can
+func (e *Endpoint) receiveParityFragment(packetData []byte) {
+	var header parityHeader
+	headerBytes, err := header.Unmarshal(packetData)
+	if err == nil {
+		err = e.checkParityHeader(&header, len(packetData)-headerBytes)
+	}
+	if err != nil {
+		log.Errorf("[%s] ignoring invalid parity fragment: %v", e.config.Name, err)
+		e.counters[counterNumFragmentsInvalid]++
+		return
+	}
+	e.lastReceiveTime = e.time
+
+	if e.receivedPackets.Exists(header.Sequence) {
+		// parity usually arrives after the fragments it covers, so this is not a duplicate
+		debugf("[%s] ignoring parity fragment %d of packet %d. packet already received", e.config.Name, header.Group, header.Sequence)
+		return
+	}
+
+	reassemblyData := e.findReassembly(header.Sequence, header.NumFragments)
+	if reassemblyData == nil {
+		return
+	}
+	if reassemblyData.ParityData == nil {
+		reassemblyData.ParityData = e.allocate(header.NumGroups * e.config.FragmentSize)
+		if reassemblyData.ParityData == nil {
+			log.Errorf("[%s] ignoring parity fragment. could not allocate %d bytes for packet %d", e.config.Name, header.NumGroups*e.config.FragmentSize, header.Sequence)
+			e.counters[counterNumAllocationsFailed]++
+			return
+		}
+		reassemblyData.NumParityGroups = header.NumGroups
+		reassemblyData.ParityReceived = [256]uint8{}
+		reassemblyData.ParityPacket = header.Packet
+	}
+	if reassemblyData.PacketBytes == 0 {
+		// the last fragment has yet to arrive
+		reassemblyData.PacketBytes = header.PacketBytes
+	}
+	if header.NumGroups != reassemblyData.NumParityGroups || header.PacketBytes != reassemblyData.PacketBytes {
+		log.Errorf("[%s] ignoring invalid parity fragment. it does not match the other fragments of packet %d", e.config.Name, header.Sequence)
+		e.counters[counterNumFragmentsInvalid]++
+		return
+	}
+	if reassemblyData.ParityReceived[header.Group] != 0 {
+		return
+	}
+
+	debugf("[%s] received parity fragment %d of packet %d", e.config.Name, header.Group, header.Sequence)
+	reassemblyData.ParityReceived[header.Group] = 1
+	copy(reassemblyData.ParityData[header.Group*e.config.FragmentSize:], packetData[headerBytes:])
+	e.recoverFragment(reassemblyData, header.Group)
+	e.completeReassembly(reassemblyData)
+
+	e.counters[counterNumFragmentsReceived]++
+}
+
+// checkParityHeader checks the parity header against the endpoint configuration
+func (e *Endpoint) checkParityHeader(header *parityHeader, parityBytes int) error {
+	fragmentSize := e.config.FragmentSize
+	if header.NumFragments > e.config.MaxFragments {
+		return fmt.Errorf("%w: num fragments %d outside of range of max fragments %d", ErrInvalidFragment, header.NumFragments, e.config.MaxFragments)
+	}
+	if header.PacketBytes <= (header.NumFragments-1)*fragmentSize || header.PacketBytes > header.NumFragments*fragmentSize {
+		return fmt.Errorf("%w: packet bytes %d do not fit %d fragments", ErrInvalidFragment, header.PacketBytes, header.NumFragments)
+	}
+	if parityBytes != fragmentSize {
+		return fmt.Errorf("%w: parity is %d bytes, which is not the expected fragment size %d", ErrInvalidFragment, parityBytes, fragmentSize)
+	}
+	return nil
+}
+
+// recoverFragment rebuilds the fragment missing from a parity group, if exactly one is missing and the
+// parity of the group arrived
+func (e *Endpoint) recoverFragment(reassemblyData *fragmentReassemblyData, group int) {
+	if reassemblyData.ParityReceived[group] == 0 {
+		return
+	}
+	numFragments, numGroups := reassemblyData.NumFragmentsTotal, reassemblyData.NumParityGroups
+	missing := -1
+	for fragmentId := group; fragmentId < numFragments; fragmentId += numGroups {
+		if reassemblyData.FragmentReceived[fragmentId] == 0 {
+			if missing >= 0 {
+				return
+			}
+			missing = fragmentId
+		}
+	}
+	if missing < 0 {
+		return
+	}
+
+	fragmentSize := e.config.FragmentSize
+	fragmentBytes := func(fragmentId int) int {
+		if fragmentId == numFragments-1 {
+			return reassemblyData.PacketBytes - fragmentId*fragmentSize
+		}
+		return fragmentSize
+	}
+	fragmentData := func(fragmentId int) []byte {
+		offset := MaxPacketHeaderBytes + fragmentId*fragmentSize
+		return reassemblyData.PacketData[offset : offset+fragmentBytes(fragmentId)]
+	}
+
+	recovered := fragmentData(missing)
+	copy(recovered, reassemblyData.ParityData[group*fragmentSize:])
+	for fragmentId := group; fragmentId < numFragments; fragmentId += numGroups {
+		if fragmentId == missing {
+			continue
+		}
+		for i, b := range fragmentData(fragmentId) {
+			if i == len(recovered) {
+				break
+			}
+			recovered[i] ^= b
+		}
+	}
+
+	debugf("[%s] recovered fragment %d of packet %d", e.config.Name, missing, reassemblyData.Sequence)
+	header := FragmentHeader{Sequence: reassemblyData.Sequence, FragmentId: missing, NumFragments: numFragments, Packet: reassemblyData.ParityPacket}
+	reassemblyData.StoreFragmentData(&header, fragmentSize, recovered)
+	reassemblyData.FragmentReceived[missing] = 1
+	reassemblyData.NumFragmentsReceived++
+	reassemblyData.NumFragmentsRecovered++
+}
@@ -0,0 +1,173 @@
+package rely
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestParityHeader(t *testing.T) {
+	writeHeader := parityHeader{
+		Sequence:     10000,
+		Group:        2,
+		NumFragments: 16,
+		NumGroups:    4,
+		PacketBytes:  15000,
+		Packet:       PacketHeader{Sequence: 10000, Ack: 9990, AckBits: 0xF0F0F0F0},
+	}
+	var data [parityHeaderBytes + MaxPacketHeaderBytes]byte
+	bytesWritten, err := writeHeader.Marshal(data[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsFragment(data[:]) || !isParity(data[:]) {
+		t.Error("Parity fragment not recognized", data[0])
+	}
+
+	var readHeader parityHeader
+	bytesRead, err := readHeader.Unmarshal(data[:bytesWritten])
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
+	}
+
+	writeHeader.Group = 4
+	writeHeader.Marshal(data[:])
+	if _, err := readHeader.Unmarshal(data[:bytesWritten]); err == nil {
+		t.Error("Expected an error for a group outside of the groups")
+	}
+
+	var fragmentHeader FragmentHeader
+	if _, err := fragmentHeader.Unmarshal(data[:bytesWritten]); err == nil {
+		t.Error("Parity fragment read as a regular fragment")
+	}
+}
+
+func TestFragmentRedundancy(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	for _, test := range []struct {
+		name        string
+		redundancy  float64
+		packetBytes int
+		lost        []int
+		recovered   bool
+		reverse     bool
+	}{
+		{"first", .25, 4000, []int{0}, true, false},
+		{"last", .25, 4000, []int{3}, true, false},
+		{"parity", .25, 4000, []int{4}, true, false},
+		{"two in a group", .25, 4000, []int{1, 2}, false, false},
+		{"two in a row", .5, 8000, []int{3, 4}, true, false},
+		{"every group", .5, 8000, []int{0, 1, 2, 3}, true, false},
+		{"full last fragment", .5, 8192, []int{7}, true, false},
+		{"every fragment", 1, 1500, []int{1}, true, false},
+		{"parity first", .5, 8000, []int{0, 5}, true, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			var context testContext
+			newTestEndpoints(&context, 100, func(config *Config) {
+				config.FragmentRedundancy = test.redundancy
+			})
+			sender, receiver := context.sender, context.receiver
+			pool := NewPool(0)
+			receiver.allocate, receiver.free = pool.Allocate, pool.Free
+
+			var sent [][]byte
+			sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+				sent = append(sent, append([]byte(nil), packetData...))
+			}
+			var processed []byte
+			receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) bool {
+				processed = append([]byte(nil), packetData...)
+				return true
+			}
+
+			packetData := make([]byte, test.packetBytes)
+			for i := range packetData {
+				packetData[i] = byte(i * 7)
+			}
+			sender.SendPacket(packetData)
+
+			if test.reverse {
+				for i, j := 0, len(sent)-1; i < j; i, j = i+1, j-1 {
+					sent[i], sent[j] = sent[j], sent[i]
+				}
+			}
+			for i, datagram := range sent {
+				lost := false
+				for _, j := range test.lost {
+					lost = lost || i == j
+				}
+				if !lost {
+					receiver.ReceivePacket(datagram)
+				}
+			}
+
+			if test.recovered != (processed != nil) {
+				t.Fatal("Expected recovered", test.recovered, "got", processed != nil)
+			}
+			if test.recovered && !bytes.Equal(processed, packetData) {
+				t.Error("Recovered packet does not match")
+			}
+			var recovered uint64
+			numFragments := (test.packetBytes + sender.config.FragmentSize - 1) / sender.config.FragmentSize
+			if test.recovered && test.lost[0] < numFragments {
+				recovered = 1
+			}
+			if receiver.PacketsRecovered() != recovered {
+				t.Error("Expected", recovered, "recovered packets, got", receiver.PacketsRecovered())
+			}
+			if test.recovered && pool.InUse() != 0 {
+				t.Error("Reassembly buffers not freed", pool.InUse())
+			}
+		})
+	}
+}
+
+func TestFragmentRedundancy_PacketBytes(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.FragmentRedundancy = .25
+	})
+	sender, receiver := context.sender, context.receiver
+
+	var sent [][]byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+	}
+	var processed []byte
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) bool {
+		processed = append([]byte(nil), packetData...)
+		return true
+	}
+	packetData := make([]byte, 4000)
+	for i := range packetData {
+		packetData[i] = byte(i * 7)
+	}
+	sender.SendPacket(packetData)
+
+	// a parity fragment claiming another packet size, after the last fragment
+	var header parityHeader
+	headerBytes, err := header.Unmarshal(sent[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.PacketBytes = 3500
+	parity := append([]byte(nil), sent[4]...)
+	header.Marshal(parity[:headerBytes])
+
+	receiver.ReceivePacket(sent[0])
+	receiver.ReceivePacket(sent[3])
+	receiver.ReceivePacket(parity)
+	if receiver.counters[counterNumFragmentsInvalid] != 1 {
+		t.Error("Expected the parity fragment to be invalid", receiver.counters[counterNumFragmentsInvalid])
+	}
+	receiver.ReceivePacket(sent[1])
+	receiver.ReceivePacket(sent[2])
+	if !bytes.Equal(processed, packetData) {
+		t.Error("Packet does not match", len(processed))
+	}
+}
@@ -1,5 +1,8 @@
 module github.com/jakecoffman/rely
 
-go 1.15
+go 1.18
 
-require github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+require (
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	gopkg.in/yaml.v3 v3.0.1
+)
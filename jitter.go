@@ -0,0 +1,231 @@
+package rely
+
+import (
+	"math"
+)
+
+// jitterDelayMultiple is how many times the measured jitter the playout delay covers
+const jitterDelayMultiple = 3
+
+// heldPacket is a received packet waiting to be delivered
+type heldPacket struct {
+	data []byte
+	// playoutTime is when the packet is delivered
+	playoutTime float64
+}
+
+// jitterBuffer holds received packets until their playout time, so that they are delivered at the steady
+// rate they were sent at. A packet's playout time is when it would have arrived if the peer sends at a
+// steady rate and the network had no jitter, plus a playout delay that covers the jitter measured so far.
+// With Config.OrderedDelivery it holds the packets that arrive ahead of a missing one instead, and their
+// playout time is when to stop waiting for it.
+type jitterBuffer struct {
+	held    *SequenceBuffer[heldPacket]
+	numHeld int
+	started bool
+	// next is the next sequence to deliver, anything older has been delivered or skipped
+	next uint16
+	// newest is the most recent sequence that arrived
+	newest uint16
+	// anchorTime is when anchorSequence was expected to arrive
+	anchorTime     float64
+	anchorSequence uint16
+	newestArrival  float64
+	// interval is the smoothed time between sequences
+	interval   float64
+	lastOffset float64
+	jitter     float64
+	delay      float64
+}
+
+func newJitterBuffer(size int) jitterBuffer {
+	return jitterBuffer{held: NewSequenceBuffer[heldPacket](size)}
+}
+
+// expected returns when the sequence is expected to arrive
+func (j *jitterBuffer) expected(sequence uint16) float64 {
+	return j.anchorTime + float64(int16(sequence-j.anchorSequence))*j.interval
+}
+
+// start makes the sequence the first to be delivered, arriving at time
+func (j *jitterBuffer) start(sequence uint16, time, delay float64) {
+	*j = jitterBuffer{
+		held:           j.held,
+		numHeld:        j.numHeld,
+		started:        true,
+		next:           sequence,
+		newest:         sequence,
+		anchorTime:     time,
+		anchorSequence: sequence,
+		newestArrival:  time,
+		delay:          delay,
+	}
+	// nothing is held before the start, the buffer may be anywhere in the sequence space
+	j.held.Sequence = sequence
+}
+
+// measure updates the send interval, jitter and playout delay with the arrival of a packet. Jitter is
+// measured like RTP does (RFC 3550), from how much later or earlier than expected packets arrive.
+func (j *jitterBuffer) measure(sequence uint16, time float64, config *Config) {
+	distance := int16(sequence - j.anchorSequence)
+	if distance > 0 {
+		sample := (time - j.newestArrival) / float64(distance)
+		if j.interval == 0 {
+			j.interval = sample
+		} else {
+			j.interval += (sample - j.interval) / 16
+		}
+	}
+
+	offset := time - j.expected(sequence)
+	j.jitter += (math.Abs(offset-j.lastOffset) - j.jitter) / 16
+	j.lastOffset = offset
+
+	// packets are expected as early as any arrived, drifting slowly towards later arrivals so that an
+	// interval estimate that is a little short does not leave every packet late
+	if offset < 0 {
+		j.anchorTime += offset
+	} else {
+		j.anchorTime += offset / 64
+	}
+	if distance > 0 {
+		j.anchorTime = j.expected(sequence)
+		j.anchorSequence = sequence
+		j.newestArrival = time
+	}
+
+	j.delay = math.Max(config.PlayoutDelay, j.jitter*jitterDelayMultiple)
+	if config.MaxPlayoutDelay > 0 {
+		j.delay = math.Min(j.delay, config.MaxPlayoutDelay)
+	}
+}
+
+// processPacket hands a received packet to the application, or holds it in the jitter buffer. It returns
+// true if the packet was accepted and should be acked.
+func (e *Endpoint) processPacket(sequence uint16, packetData []byte) bool {
+	if !e.config.JitterBuffer && !e.config.OrderedDelivery {
+		return e.config.ProcessPacketFunction(e.config.Context, e.config.Index, sequence, packetData)
+	}
+	return e.holdPacket(sequence, packetData)
+}
+
+// holdPacket copies a received packet into the jitter buffer, or delivers it right away if it is the next
+// one in order with Config.OrderedDelivery. Packets that arrive after their sequence was delivered or
+// skipped are dropped as late.
+func (e *Endpoint) holdPacket(sequence uint16, packetData []byte) bool {
+	j := &e.jitter
+	if !j.started {
+		j.start(sequence, e.time, e.config.PlayoutDelay)
+	} else if SequenceLessThan(sequence, j.next) {
+		log.Errorf("[%s] dropping packet %d. it arrived after a later packet was delivered", e.config.Name, sequence)
+		e.counters[counterNumPacketsLate]++
+		return false
+	} else if e.config.JitterBuffer {
+		j.measure(sequence, e.time, e.config)
+	}
+	if SequenceLessThan(sequence, j.newest) {
+		e.counters[counterNumPacketsReordered]++
+	} else {
+		j.newest = sequence
+	}
+
+	if e.config.OrderedDelivery && sequence == j.next {
+		debugf("[%s] delivering packet %d in order", e.config.Name, sequence)
+		e.config.ProcessPacketFunction(e.config.Context, e.config.Index, sequence, packetData)
+		j.next = sequence + 1
+		e.releaseHeldPackets()
+		return true
+	}
+	if j.held.Exists(sequence) {
+		return true
+	}
+
+	data := e.allocate(len(packetData))
+	if data == nil {
+		log.Errorf("[%s] ignoring packet. could not allocate %d bytes to hold packet %d", e.config.Name, len(packetData), sequence)
+		e.counters[counterNumAllocationsFailed]++
+		return false
+	}
+	copy(data, packetData)
+
+	// packets that would be pushed out of the buffer are delivered early rather than lost
+	e.deliverHeldPackets(sequence + 1 - uint16(j.held.NumEntries))
+	held := j.held.Insert(sequence)
+	held.data = data
+	j.numHeld++
+	if e.config.JitterBuffer {
+		held.playoutTime = j.expected(sequence) + j.delay
+	} else {
+		held.playoutTime = e.time + e.config.MaxReorderWait
+	}
+	debugf("[%s] holding packet %d for %.3f seconds", e.config.Name, sequence, held.playoutTime-e.time)
+	return true
+}
+
+// releaseHeldPackets delivers the held packets whose playout time has come, in sequence order. Sequences
+// that have not arrived are skipped once a packet after them is due. With Config.OrderedDelivery the
+// next packet in order is always due.
+func (e *Endpoint) releaseHeldPackets() {
+	j := &e.jitter
+	for j.numHeld > 0 {
+		sequence := j.next
+		held := j.held.Find(sequence)
+		for held == nil && SequenceLessThan(sequence+1, j.held.Sequence) {
+			sequence++
+			held = j.held.Find(sequence)
+		}
+		if held == nil || held.playoutTime > e.time && (e.config.JitterBuffer || sequence != j.next) {
+			return
+		}
+		if sequence != j.next {
+			debugf("[%s] skipping packets %d to %d, they did not arrive in time", e.config.Name, j.next, sequence-1)
+			e.counters[counterNumPacketsSkipped] += uint64(sequence - j.next)
+		}
+		e.deliverHeldPacket(sequence, held)
+	}
+}
+
+// deliverHeldPackets delivers the held packets older than the sequence right away
+func (e *Endpoint) deliverHeldPackets(sequence uint16) {
+	j := &e.jitter
+	for j.numHeld > 0 && SequenceLessThan(j.next, sequence) {
+		if held := j.held.Find(j.next); held != nil {
+			e.deliverHeldPacket(j.next, held)
+		} else {
+			e.counters[counterNumPacketsSkipped]++
+			j.next++
+		}
+	}
+}
+
+func (e *Endpoint) deliverHeldPacket(sequence uint16, held *heldPacket) {
+	debugf("[%s] delivering held packet %d", e.config.Name, sequence)
+	e.config.ProcessPacketFunction(e.config.Context, e.config.Index, sequence, held.data)
+	e.free(held.data)
+	e.jitter.held.Remove(sequence)
+	e.jitter.numHeld--
+	e.jitter.next = sequence + 1
+}
+
+// resetJitterBuffer frees the held packets without delivering them
+func (e *Endpoint) resetJitterBuffer() {
+	j := &e.jitter
+	for i := 0; i < j.held.NumEntries; i++ {
+		if held := j.held.AtIndex(i); held != nil {
+			e.free(held.data)
+		}
+	}
+	j.held.Reset()
+	j.numHeld = 0
+	j.started = false
+}
+
+// Jitter returns the measured jitter of received packets in milliseconds, while the jitter buffer is enabled
+func (e *Endpoint) Jitter() float64 {
+	return e.jitter.jitter * 1000
+}
+
+// PlayoutDelay returns the current playout delay of the jitter buffer in seconds
+func (e *Endpoint) PlayoutDelay() float64 {
+	return e.jitter.delay
+}
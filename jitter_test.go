@@ -0,0 +1,285 @@
+package rely
+
+import (
+	"math"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+type jitterDelivery struct {
+	sequence uint16
+	time     float64
+}
+
+// newJitterEndpoints returns endpoints where the sender's packets are queued for the test to deliver,
+// and the receiver records the packets it delivers
+func newJitterEndpoints(context *testContext, queued *[][]byte, delivered *[]jitterDelivery) {
+	newTestEndpoints(context, 100, func(config *Config) {
+		config.JitterBuffer = true
+		config.PlayoutDelay = .05
+		config.MaxPlayoutDelay = .2
+	})
+	context.sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		*queued = append(*queued, append([]byte(nil), packetData...))
+	}
+	receiver := context.receiver
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, sequence uint16, _ []byte) bool {
+		*delivered = append(*delivered, jitterDelivery{sequence, receiver.time})
+		return true
+	}
+}
+
+func TestJitterBuffer(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+
+	// packets are sent at 60Hz and every other one is 20ms late
+	const numPackets = 240
+	type arrival struct {
+		time       float64
+		packetData []byte
+	}
+	var arrivals []arrival
+	for i := 0; i < numPackets; i++ {
+		time := 100 + float64(i)/60
+		sender.Update(time)
+		sender.SendPacket([]byte{byte(i)})
+		arrivals = append(arrivals, arrival{time + float64(i%2)*.02, queued[i]})
+	}
+
+	for tick := 0; len(delivered) < numPackets && tick < 6000; tick++ {
+		time := 100 + float64(tick)/1000
+		receiver.Update(time)
+		for len(arrivals) > 0 && arrivals[0].time <= time {
+			before := len(delivered)
+			receiver.ReceivePacket(arrivals[0].packetData)
+			if len(delivered) != before {
+				t.Fatal("packet delivered on arrival")
+			}
+			arrivals = arrivals[1:]
+		}
+	}
+
+	if len(delivered) != numPackets || receiver.PacketsLate() != 0 {
+		t.Fatal("Expected all packets delivered, got", len(delivered), "with", receiver.PacketsLate(), "late")
+	}
+	for i, delivery := range delivered {
+		if delivery.sequence != uint16(i) {
+			t.Fatal("Expected packet", i, "got", delivery.sequence)
+		}
+		if i > numPackets/2 {
+			interval := delivery.time - delivered[i-1].time
+			if math.Abs(interval-1.0/60) > .003 {
+				t.Error("Packet", i, "delivered", interval, "after the one before")
+			}
+		}
+	}
+	if jitter := receiver.Jitter(); jitter < 15 || jitter > 25 {
+		t.Error("Expected about 20ms jitter, got", jitter)
+	}
+	if delay := receiver.PlayoutDelay(); delay < .05 || delay > .075 {
+		t.Error("Expected playout delay to cover the jitter, got", delay)
+	}
+}
+
+func TestJitterBuffer_Late(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+
+	for i := 0; i < 4; i++ {
+		sender.SendPacket([]byte{byte(i)})
+	}
+	receiver.ReceivePacket(queued[0])
+	receiver.ReceivePacket(queued[2])
+	receiver.ReceivePacket(queued[3])
+	receiver.Update(101)
+	if len(delivered) != 3 || delivered[1].sequence != 2 || receiver.PacketsSkipped() != 1 {
+		t.Fatal("Expected packet 1 to be skipped, got", delivered, receiver.PacketsSkipped())
+	}
+
+	receiver.ReceivePacket(queued[1])
+	receiver.Update(102)
+	if len(delivered) != 3 || receiver.PacketsLate() != 1 {
+		t.Error("Expected packet 1 to be dropped as late, got", delivered, receiver.PacketsLate())
+	}
+	if receiver.receivedPackets.Exists(1) {
+		t.Error("Late packet was acked")
+	}
+}
+
+func TestJitterBuffer_Start(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+
+	// turned on half way through the sequence space
+	config := *receiver.config
+	config.JitterBuffer = false
+	if err := receiver.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 40000; i++ {
+		sender.SendPacket([]byte{1})
+		receiver.ReceivePacket(queued[0])
+		queued = queued[:0]
+	}
+	config.JitterBuffer = true
+	if err := receiver.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	delivered = delivered[:0]
+
+	sender.SendPacket([]byte{1})
+	receiver.ReceivePacket(queued[0])
+	receiver.Update(101)
+	if len(delivered) != 1 || delivered[0].sequence != 40000 {
+		t.Error("Expected the packet to be held and delivered, got", delivered)
+	}
+}
+
+func TestJitterBuffer_Free(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+	pool := NewPool(0)
+	receiver.allocate, receiver.free = pool.Allocate, pool.Free
+
+	for i := 0; i < 3; i++ {
+		sender.SendPacket(make([]byte, 100))
+		receiver.ReceivePacket(queued[i])
+	}
+	if pool.InUse() == 0 {
+		t.Fatal("Expected packets to be held")
+	}
+	receiver.Reset()
+	if pool.InUse() != 0 || len(delivered) != 0 {
+		t.Error("Reset did not free held packets", pool.InUse(), len(delivered))
+	}
+
+	// a full buffer delivers its oldest packets early
+	for i := 3; i < 3+receiver.jitter.held.NumEntries+2; i++ {
+		sender.SendPacket([]byte{byte(i)})
+		receiver.ReceivePacket(queued[i])
+	}
+	if len(delivered) != 2 || delivered[0].sequence != 3 || delivered[1].sequence != 4 {
+		t.Error("Expected the oldest packets to be delivered, got", delivered)
+	}
+
+	// turning the jitter buffer off delivers the rest
+	config := *receiver.config
+	config.JitterBuffer = false
+	if err := receiver.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if len(delivered) != receiver.config.ReceivedPacketsBufferSize+2 || pool.InUse() != 0 {
+		t.Error("Expected held packets to be delivered, got", len(delivered), pool.InUse())
+	}
+}
+
+func TestJitterBuffer_Resync(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+	receiver.config.ExtendedSequences = true
+
+	// run through a wrap of the 16 bit sequence, the last packets are held
+	for i := 0; i < 70000; i++ {
+		sender.SendPacket([]byte{1})
+		receiver.ReceivePacket(queued[0])
+		queued = queued[:0]
+	}
+	held := len(delivered)
+
+	// a long stall, during which the sender moves 40000 packets on
+	for i := 0; i < 40000+resyncStalePackets; i++ {
+		sender.SendPacket([]byte{1})
+	}
+	receiver.lastSequenceTime -= resyncStallTime
+	for _, packetData := range queued[len(queued)-resyncStalePackets:] {
+		receiver.ReceivePacket(packetData)
+	}
+	if len(delivered) <= held || delivered[len(delivered)-1].sequence != 69999-65536 {
+		t.Error("Expected the held packets to be delivered on resync, got", len(delivered)-held)
+	}
+}
+
+func TestOrderedDelivery(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	var queued [][]byte
+	var delivered []jitterDelivery
+	newJitterEndpoints(&context, &queued, &delivered)
+	sender, receiver := context.sender, context.receiver
+	receiver.config.JitterBuffer = false
+	receiver.config.OrderedDelivery = true
+	receiver.config.MaxReorderWait = .1
+
+	for i := 0; i < 8; i++ {
+		sender.SendPacket([]byte{byte(i)})
+	}
+	expect := func(sequences ...uint16) {
+		t.Helper()
+		if len(delivered) != len(sequences) {
+			t.Fatal("Expected", sequences, "got", delivered)
+		}
+		for i, sequence := range sequences {
+			if delivered[i].sequence != sequence {
+				t.Fatal("Expected", sequences, "got", delivered)
+			}
+		}
+	}
+
+	// in order packets are delivered right away, and a reordered one releases the ones held behind it
+	receiver.ReceivePacket(queued[0])
+	receiver.ReceivePacket(queued[2])
+	receiver.ReceivePacket(queued[3])
+	expect(0)
+	receiver.ReceivePacket(queued[1])
+	expect(0, 1, 2, 3)
+	if receiver.PacketsReordered() != 1 {
+		t.Error("Expected 1 reordered packet, got", receiver.PacketsReordered())
+	}
+
+	// a missing packet is waited for, then skipped
+	receiver.ReceivePacket(queued[5])
+	receiver.ReceivePacket(queued[6])
+	receiver.Update(100.05)
+	expect(0, 1, 2, 3)
+	receiver.Update(100.1)
+	expect(0, 1, 2, 3, 5, 6)
+	if receiver.PacketsSkipped() != 1 {
+		t.Error("Expected 1 skipped packet, got", receiver.PacketsSkipped())
+	}
+
+	// and dropped if it shows up after all
+	receiver.ReceivePacket(queued[4])
+	receiver.ReceivePacket(queued[7])
+	expect(0, 1, 2, 3, 5, 6, 7)
+	if receiver.PacketsLate() != 1 || receiver.receivedPackets.Exists(4) || !receiver.receivedPackets.Exists(6) {
+		t.Error("Expected packet 4 to be dropped, got", receiver.PacketsLate())
+	}
+}
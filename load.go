@@ -0,0 +1,193 @@
+package rely
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadJSON overrides config fields with the values of a JSON object. Keys are field names, matched
+// ignoring case, underscores and dashes, so "FragmentAbove" and "fragment_above" are the same field.
+// Callbacks and Context cannot be loaded, so set them first: the config is only changed if every value
+// loads and the result passes Validate.
+func (c *Config) LoadJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return c.load(func(config *Config) error {
+		for key, value := range fields {
+			value := value
+			err := config.loadField(key, func(field interface{}) error {
+				return json.Unmarshal(value, field)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadYAML overrides config fields with the values of a YAML mapping, the same way as LoadJSON
+func (c *Config) LoadYAML(data []byte) error {
+	var fields map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+	return c.load(func(config *Config) error {
+		for key, value := range fields {
+			value := value
+			err := config.loadField(key, func(field interface{}) error {
+				return value.Decode(field)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load decodes into a copy of the config, which replaces it once decoding and Validate both succeed
+func (c *Config) load(decode func(config *Config) error) error {
+	config := *c
+	if err := decode(&config); err != nil {
+		return err
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	*c = config
+	return nil
+}
+
+// LoadFile overrides config fields from a JSON or YAML file, depending on its extension
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return c.LoadJSON(data)
+	case ".yaml", ".yml":
+		return c.LoadYAML(data)
+	}
+	return fmt.Errorf("%w: unknown config file type %q", ErrInvalidConfig, path)
+}
+
+// LoadEnv overrides config fields from environment variables named by the prefix and the field name
+// in upper snake case. With the prefix "RELY_", RELY_FRAGMENT_ABOVE=1200 sets FragmentAbove. Call Validate
+// once everything is loaded.
+func (c *Config) LoadEnv(prefix string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value, ok := os.LookupEnv(prefix + envName(name))
+		if !ok || !loadable(v.Field(i)) {
+			continue
+		}
+		err := c.loadField(name, func(field interface{}) error {
+			return parseValue(value, reflect.ValueOf(field).Elem())
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadField finds the field named by key and passes a pointer to it to decode
+func (c *Config) loadField(key string, decode func(field interface{}) error) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if normalizeFieldName(name) != normalizeFieldName(key) {
+			continue
+		}
+		if !loadable(v.Field(i)) {
+			return fmt.Errorf("%w: %s cannot be loaded", ErrInvalidConfig, name)
+		}
+		if err := decode(v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unknown field %q", ErrInvalidConfig, key)
+}
+
+// loadable returns true for the fields that can be set from text
+func loadable(field reflect.Value) bool {
+	switch field.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Uint16, reflect.Uint32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func parseValue(s string, field reflect.Value) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.ParseInt(s, 0, 0)
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+	case reflect.Uint16, reflect.Uint32:
+		n, err := strconv.ParseUint(s, 0, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	}
+	return nil
+}
+
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(name))
+}
+
+// envName turns a field name into upper snake case, keeping initialisms together: ReliableIOCompatible
+// becomes RELIABLE_IO_COMPATIBLE
+func envName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if i > 0 && isUpper(r) {
+			previous, next := rune(name[i-1]), rune(0)
+			if i+1 < len(name) {
+				next = rune(name[i+1])
+			}
+			if !isUpper(previous) || (next != 0 && !isUpper(next)) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(r)
+	}
+	return strings.ToUpper(b.String())
+}
+
+func isUpper(r rune) bool {
+	return r >= 'A' && r <= 'Z'
+}
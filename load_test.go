@@ -0,0 +1,138 @@
+package rely
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newLoadConfig returns a default config with the callbacks set, so that it passes Validate
+func newLoadConfig() *Config {
+	config := NewDefaultConfig()
+	config.TransmitPacketFunction = testTransmitPacketFunction
+	config.ProcessPacketFunction = testProcessPacketFunction
+	return config
+}
+
+func TestConfig_LoadJSON(t *testing.T) {
+	config := newLoadConfig()
+	err := config.LoadJSON([]byte(`{"FragmentAbove": 1200, "rtt_smoothing_factor": 0.01, "checksum": true, "ProtocolId": 305419896, "Name": "server"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FragmentAbove != 1200 || config.RttSmoothingFactor != .01 || !config.Checksum || config.ProtocolId != 0x12345678 || config.Name != "server" {
+		t.Error("Fields not loaded", config)
+	}
+	if config.MaxPacketSize != 16*1024 {
+		t.Error("Field not in JSON was changed", config.MaxPacketSize)
+	}
+
+	for _, data := range []string{
+		`{"NoSuchField": 1}`,
+		`{"ProtocolVersion": 70000}`,
+		`{"FragmentAbove": "big"}`,
+		`{"TransmitPacketFunction": null}`,
+		`[1, 2]`,
+	} {
+		if err := newLoadConfig().LoadJSON([]byte(data)); !errors.Is(err, ErrInvalidConfig) {
+			t.Error("Expected error loading", data, "got", err)
+		}
+	}
+
+	// nothing is changed unless everything loads and is valid
+	for _, data := range []string{
+		`{"MaxPacketSize": 1000, "ProtocolVersion": 70000}`,
+		`{"MaxPacketSize": 1000, "MaxFragments": 0}`,
+	} {
+		config := newLoadConfig()
+		if err := config.LoadJSON([]byte(data)); !errors.Is(err, ErrInvalidConfig) || config.MaxPacketSize != 16*1024 {
+			t.Error("Expected the config to be unchanged loading", data, "got", err, config.MaxPacketSize)
+		}
+	}
+}
+
+func TestConfig_LoadYAML(t *testing.T) {
+	config := newLoadConfig()
+	err := config.LoadYAML([]byte("fragment-above: 1200\nAckWindow: 64\nreliable_io_compatible: false\ntimeout: 7.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FragmentAbove != 1200 || config.AckWindow != 64 || config.Timeout != 7.5 {
+		t.Error("Fields not loaded", config)
+	}
+
+	config = newLoadConfig()
+	if err := config.LoadYAML([]byte("MaxPacketSize: 1000\nAckWindow: [1]\n")); !errors.Is(err, ErrInvalidConfig) || config.MaxPacketSize != 16*1024 {
+		t.Error("Expected error without changing the config", err, config.MaxPacketSize)
+	}
+}
+
+func TestConfig_LoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rely")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json": `{"MaxFragments": 32}`,
+		"config.yml":  "MaxFragments: 32\n",
+		"config.yaml": "MaxFragments: 32\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config := newLoadConfig()
+		if err := config.LoadFile(path); err != nil || config.MaxFragments != 32 {
+			t.Error("Could not load", name, err)
+		}
+	}
+
+	if err := newLoadConfig().LoadFile(filepath.Join(dir, "config.toml")); err == nil {
+		t.Error("Expected error for missing file")
+	}
+}
+
+func TestConfig_LoadEnv(t *testing.T) {
+	env := map[string]string{
+		"RELYTEST_FRAGMENT_ABOVE":               "0x400",
+		"RELYTEST_RELIABLE_IO_COMPATIBLE":       "true",
+		"RELYTEST_PACKET_LOSS_SMOOTHING_FACTOR": "0.5",
+		"RELYTEST_PROTOCOL_VERSION":             "3",
+		"RELYTEST_NAME":                         "server",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	config := NewDefaultConfig()
+	if err := config.LoadEnv("RELYTEST_"); err != nil {
+		t.Fatal(err)
+	}
+	if config.FragmentAbove != 1024 || !config.ReliableIOCompatible || config.PacketLossSmoothingFactor != .5 || config.ProtocolVersion != 3 || config.Name != "server" {
+		t.Error("Fields not loaded", config)
+	}
+
+	os.Setenv("RELYTEST_PROTOCOL_VERSION", "70000")
+	if err := NewDefaultConfig().LoadEnv("RELYTEST_"); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Expected error", err)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"Name":                         "NAME",
+		"FragmentReassemblyBufferSize": "FRAGMENT_REASSEMBLY_BUFFER_SIZE",
+		"ReliableIOCompatible":         "RELIABLE_IO_COMPATIBLE",
+		"ProtocolId":                   "PROTOCOL_ID",
+	} {
+		if actual := envName(name); actual != expected {
+			t.Error("Expected", expected, "got", actual)
+		}
+	}
+}
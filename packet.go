@@ -1,45 +1,398 @@
 package rely
 
+import (
+	"errors"
+	"fmt"
+)
+
 type sentPacketData struct {
-	Time float64
-	Acked uint32 // use only 1 bit
+	Time        float64
+	Acked       uint32 // use only 1 bit
 	PacketBytes uint32 // use only 31 bits
+	Snapshot    uint64 // the application snapshot the packet carried, see SendSnapshotPacket
+	HasSnapshot bool
+	InFlight    bool // counted in the bytes in flight, see Config.CongestionController
 }
 
 type receivedPacketData struct {
-	Time float64
+	Time        float64
 	PacketBytes uint32
 }
 
 type fragmentReassemblyData struct {
-	Sequence uint16
-	Ack uint16
-	AckBits uint32
+	Sequence             uint16
+	Ack                  uint16
+	AckBits              uint64
 	NumFragmentsReceived int
-	NumFragmentsTotal int
-	PacketData []byte
-	PacketBytes int
-	PacketHeaderBytes int
-	FragmentReceived [256]uint8
-}
-
-func (f *fragmentReassemblyData) StoreFragmentData(sequence, ack uint16, ackBits uint32, fragmentId, fragmentSize int, fragmentData []byte) {
-	// if this is the first fragment, write the header and advance the fragmentData cursor
-	if fragmentId == 0 {
-		packetHeader := newBuffer(MaxPacketHeaderBytes)
-		f.PacketHeaderBytes = writePacketHeader(packetHeader, sequence, ack, ackBits)
+	NumFragmentsTotal    int
+	PacketData           []byte
+	PacketBytes          int
+	PacketHeaderBytes    int
+	FragmentReceived     [256]uint8
+	// the parity fragments of the packet, see Config.FragmentRedundancy
+	ParityData            []byte
+	NumParityGroups       int
+	ParityReceived        [256]uint8
+	ParityPacket          PacketHeader
+	NumFragmentsRecovered int
+}
+
+// StoreFragmentData copies the fragment data (without any headers) into the reassembly buffer
+func (f *fragmentReassemblyData) StoreFragmentData(header *FragmentHeader, fragmentSize int, fragmentData []byte) {
+	// if this is the first fragment, write the packet header in front of the packet data
+	if header.FragmentId == 0 {
+		var packetHeader [MaxPacketHeaderBytes]byte
+		f.PacketHeaderBytes, _ = header.Packet.Marshal(packetHeader[:])
 		// leaves a gap at the front of the buffer?
-		copy(f.PacketData[MaxPacketHeaderBytes-f.PacketHeaderBytes:], packetHeader.bytes())
-		fragmentData = fragmentData[f.PacketHeaderBytes:]
+		copy(f.PacketData[MaxPacketHeaderBytes-f.PacketHeaderBytes:], packetHeader[:f.PacketHeaderBytes])
 	}
 
 	// if this is the last fragment, we know the final size of the packet
-	if fragmentId == f.NumFragmentsTotal - 1 {
-		f.PacketBytes = (f.NumFragmentsTotal-1) * fragmentSize + len(fragmentData)
+	if header.FragmentId == f.NumFragmentsTotal-1 {
+		f.PacketBytes = (f.NumFragmentsTotal-1)*fragmentSize + len(fragmentData)
 	}
 
 	// copy the fragment data into the right spot in the array
-	copy(f.PacketData[MaxPacketHeaderBytes+fragmentId*fragmentSize:], fragmentData)
+	copy(f.PacketData[MaxPacketHeaderBytes+header.FragmentId*fragmentSize:], fragmentData)
 }
 
 func (f *fragmentReassemblyData) Cleanup() {}
+
+var (
+	// ErrShortBuffer is returned by Marshal when the destination is too small for the header
+	ErrShortBuffer = errors.New("rely: buffer too small for header")
+	// ErrPacketTooSmall is returned by Unmarshal when the data ends before the header does
+	ErrPacketTooSmall = errors.New("rely: packet too small for header")
+	// ErrNotRegularPacket is returned when the prefix byte does not indicate a regular packet
+	ErrNotRegularPacket = errors.New("rely: prefix byte does not indicate a regular packet")
+	// ErrNotFragment is returned when the prefix byte does not indicate a fragment
+	ErrNotFragment = errors.New("rely: prefix byte is not a fragment")
+	// ErrInvalidFragment is returned when a fragment header is inconsistent
+	ErrInvalidFragment = errors.New("rely: invalid fragment header")
+)
+
+// IsFragment reports whether the datagram is a fragment of a larger packet, judging by its prefix byte
+func IsFragment(packetData []byte) bool {
+	return len(packetData) > 0 && packetData[0]&1 != 0
+}
+
+// The prefix byte of a regular packet:
+//
+//	bit 0     0 for a regular packet, 1 for a fragment
+//	bits 1-4  set when the corresponding byte of the first 32 ack bits is written, otherwise it is 0xFF
+//	bit 5     set when the ack is written as a one byte difference from the sequence
+//	bit 6     set when a flags byte follows the ack
+//	bit 7     set when the payload is compressed, see Config.Compressor
+//
+// The flags byte extends the header beyond the reliable.io format:
+//
+//	bit 0     set when the upper 32 ack bits are written, otherwise they are 0
+//	bits 1-4  set when the corresponding byte of the upper 32 ack bits is written, otherwise it is 0xFF
+//	bit 5     set for ack-only packets, which carry no payload and do not use up a sequence
+//	bit 6     set when copies of earlier payloads precede the payload, see Config.RedundantPayloads
+const (
+	prefixSequenceDifference = 1 << 5
+	prefixFlags              = 1 << 6
+	prefixCompressed         = 1 << 7
+
+	flagWideAcks  = 1 << 0
+	flagAckOnly   = 1 << 5
+	flagRedundant = 1 << 6
+)
+
+// PacketHeader is written in front of every regular packet, and in front of the first fragment
+// of a fragmented packet. It can be used to inspect sequence and ack information without an Endpoint.
+type PacketHeader struct {
+	// Sequence is the sequence number of the packet
+	Sequence uint16
+	// Ack is the most recent sequence received by the sender of the packet
+	Ack uint16
+	// AckBits has bit n set if Ack-n was received by the sender of the packet. The upper 32 bits
+	// are only sent by endpoints with a 64 packet Config.AckWindow.
+	AckBits uint64
+	// AckOnly is set for packets sent by Endpoint.SendAck. Their sequence is the next one the sender
+	// will use, and they are not acked themselves.
+	AckOnly bool
+	// Redundant is set when the payload is preceded by copies of earlier payloads
+	Redundant bool
+	// Compressed is set when the payload is compressed
+	Compressed bool
+}
+
+// Size returns the number of bytes Marshal will write
+func (h *PacketHeader) Size() int {
+	prefixByte, flags := h.prefixByte(), h.flags()
+	size := 1 + 2 + 2
+	if prefixByte&prefixSequenceDifference != 0 {
+		size--
+	}
+	if prefixByte&prefixFlags != 0 {
+		size++
+	}
+	for i := uint(1); i <= 4; i++ {
+		if prefixByte&(1<<i) != 0 {
+			size++
+		}
+		if flags&(1<<i) != 0 {
+			size++
+		}
+	}
+	return size
+}
+
+func (h *PacketHeader) sequenceDifference() int {
+	return int(h.Sequence - h.Ack)
+}
+
+func (h *PacketHeader) prefixByte() uint8 {
+	var prefixByte uint8
+
+	for i := uint(0); i < 4; i++ {
+		if (h.AckBits>>(8*i))&0xFF != 0xFF {
+			prefixByte |= 1 << (i + 1)
+		}
+	}
+
+	if h.sequenceDifference() <= 255 {
+		prefixByte |= prefixSequenceDifference
+	}
+
+	if h.flags() != 0 {
+		prefixByte |= prefixFlags
+	}
+
+	if h.Compressed {
+		prefixByte |= prefixCompressed
+	}
+
+	return prefixByte
+}
+
+func (h *PacketHeader) flags() uint8 {
+	var flags uint8
+
+	if h.AckBits>>32 != 0 {
+		flags |= flagWideAcks
+		for i := uint(0); i < 4; i++ {
+			if (h.AckBits>>(32+8*i))&0xFF != 0xFF {
+				flags |= 1 << (i + 1)
+			}
+		}
+	}
+
+	if h.AckOnly {
+		flags |= flagAckOnly
+	}
+
+	if h.Redundant {
+		flags |= flagRedundant
+	}
+
+	return flags
+}
+
+// Marshal writes the header to the front of data and returns the number of bytes written
+func (h *PacketHeader) Marshal(data []byte) (int, error) {
+	if len(data) < h.Size() {
+		return 0, ErrShortBuffer
+	}
+
+	prefixByte, flags := h.prefixByte(), h.flags()
+
+	p := buffer{buf: data}
+	p.writeUint8(prefixByte)
+	p.writeUint16(h.Sequence)
+
+	if prefixByte&prefixSequenceDifference != 0 {
+		p.writeUint8(uint8(h.sequenceDifference()))
+	} else {
+		p.writeUint16(h.Ack)
+	}
+
+	if prefixByte&prefixFlags != 0 {
+		p.writeUint8(flags)
+	}
+
+	for i := uint(0); i < 4; i++ {
+		if prefixByte&(1<<(i+1)) != 0 {
+			p.writeUint8(uint8(h.AckBits >> (8 * i)))
+		}
+	}
+	for i := uint(0); i < 4; i++ {
+		if flags&(1<<(i+1)) != 0 {
+			p.writeUint8(uint8(h.AckBits >> (32 + 8*i)))
+		}
+	}
+
+	return p.pos, nil
+}
+
+// Unmarshal reads the header from the front of data and returns the number of bytes read
+func (h *PacketHeader) Unmarshal(data []byte) (int, error) {
+	packetBytes := len(data)
+	if packetBytes < 3 {
+		return 0, ErrPacketTooSmall
+	}
+	p := buffer{buf: data}
+
+	prefixByte, _ := p.getUint8()
+
+	if (prefixByte & 1) != 0 {
+		return 0, ErrNotRegularPacket
+	}
+
+	h.Sequence, _ = p.getUint16()
+	if prefixByte&prefixSequenceDifference != 0 {
+		if packetBytes < 3+1 {
+			return 0, ErrPacketTooSmall
+		}
+		sequenceDifference, _ := p.getUint8()
+		h.Ack = h.Sequence - uint16(sequenceDifference)
+	} else {
+		if packetBytes < 3+2 {
+			return 0, ErrPacketTooSmall
+		}
+		h.Ack, _ = p.getUint16()
+	}
+
+	var flags uint8
+	if prefixByte&prefixFlags != 0 {
+		if packetBytes < p.pos+1 {
+			return 0, ErrPacketTooSmall
+		}
+		flags, _ = p.getUint8()
+	}
+	h.AckOnly = flags&flagAckOnly != 0
+	h.Compressed = prefixByte&prefixCompressed != 0
+	h.Redundant = flags&flagRedundant != 0
+
+	var expectedBytes int
+	for i := uint(1); i <= 4; i++ {
+		if prefixByte&(1<<i) != 0 {
+			expectedBytes++
+		}
+		if flags&flagWideAcks != 0 && flags&(1<<i) != 0 {
+			expectedBytes++
+		}
+	}
+	if packetBytes < p.pos+expectedBytes {
+		return 0, ErrPacketTooSmall
+	}
+
+	h.AckBits = 0xFFFFFFFF
+	for i := uint(0); i < 4; i++ {
+		if prefixByte&(1<<(i+1)) != 0 {
+			b, _ := p.getUint8()
+			h.AckBits &^= 0xFF << (8 * i)
+			h.AckBits |= uint64(b) << (8 * i)
+		}
+	}
+	if flags&flagWideAcks != 0 {
+		h.AckBits |= 0xFFFFFFFF << 32
+		for i := uint(0); i < 4; i++ {
+			if flags&(1<<(i+1)) != 0 {
+				b, _ := p.getUint8()
+				h.AckBits &^= 0xFF << (32 + 8*i)
+				h.AckBits |= uint64(b) << (32 + 8*i)
+			}
+		}
+	}
+
+	return p.pos, nil
+}
+
+// FragmentHeader is written in front of every fragment of a fragmented packet
+type FragmentHeader struct {
+	// Sequence is the sequence number of the fragmented packet
+	Sequence uint16
+	// FragmentId is the index of this fragment, from 0 to NumFragments-1
+	FragmentId int
+	// NumFragments is the number of fragments the packet was split into, from 1 to 256
+	NumFragments int
+	// Packet is the header of the fragmented packet, which is only sent with the first fragment
+	Packet PacketHeader
+}
+
+// Size returns the number of bytes Marshal will write
+func (h *FragmentHeader) Size() int {
+	if h.FragmentId == 0 {
+		return FragmentHeaderBytes + h.Packet.Size()
+	}
+	return FragmentHeaderBytes
+}
+
+// Marshal writes the header to the front of data and returns the number of bytes written.
+// The first fragment also gets the packet header written after the fragment header.
+func (h *FragmentHeader) Marshal(data []byte) (int, error) {
+	if err := h.validate(); err != nil {
+		return 0, err
+	}
+	if len(data) < h.Size() {
+		return 0, ErrShortBuffer
+	}
+
+	p := buffer{buf: data}
+	p.writeUint8(1)
+	p.writeUint16(h.Sequence)
+	p.writeUint8(uint8(h.FragmentId))
+	p.writeUint8(uint8(h.NumFragments - 1))
+
+	if h.FragmentId == 0 {
+		n, err := h.Packet.Marshal(data[p.pos:])
+		if err != nil {
+			return 0, err
+		}
+		p.pos += n
+	}
+
+	return p.pos, nil
+}
+
+// Unmarshal reads the header from the front of data and returns the number of bytes read,
+// which for the first fragment includes the packet header.
+func (h *FragmentHeader) Unmarshal(data []byte) (int, error) {
+	if len(data) < FragmentHeaderBytes {
+		return 0, ErrPacketTooSmall
+	}
+
+	p := buffer{buf: data}
+	prefixByte, _ := p.getUint8()
+	if prefixByte != 1 {
+		return 0, ErrNotFragment
+	}
+
+	h.Sequence, _ = p.getUint16()
+	tmp, _ := p.getUint8()
+	h.FragmentId = int(tmp)
+	tmp, _ = p.getUint8()
+	h.NumFragments = int(tmp) + 1
+
+	if err := h.validate(); err != nil {
+		return 0, err
+	}
+
+	h.Packet = PacketHeader{}
+	if h.FragmentId == 0 {
+		n, err := h.Packet.Unmarshal(data[p.pos:])
+		if err != nil {
+			return 0, fmt.Errorf("%w: bad packet header in fragment: %v", ErrInvalidFragment, err)
+		}
+
+		if h.Packet.Sequence != h.Sequence {
+			return 0, fmt.Errorf("%w: bad packet sequence in fragment. expected %d, got %d", ErrInvalidFragment, h.Sequence, h.Packet.Sequence)
+		}
+		p.pos += n
+	}
+
+	return p.pos, nil
+}
+
+func (h *FragmentHeader) validate() error {
+	if h.NumFragments < 1 || h.NumFragments > 256 {
+		return fmt.Errorf("%w: num fragments %d outside of range 1-256", ErrInvalidFragment, h.NumFragments)
+	}
+	if h.FragmentId < 0 || h.FragmentId >= h.NumFragments {
+		return fmt.Errorf("%w: fragment id %d outside of range of num fragments %d", ErrInvalidFragment, h.FragmentId, h.NumFragments)
+	}
+	return nil
+}
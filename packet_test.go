@@ -0,0 +1,70 @@
+package rely
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPacketHeader_Errors(t *testing.T) {
+	header := PacketHeader{Sequence: 10000, Ack: 100}
+
+	if _, err := header.Marshal(make([]byte, header.Size()-1)); err != ErrShortBuffer {
+		t.Error("Expected ErrShortBuffer but got", err)
+	}
+
+	packetData := make([]byte, MaxPacketHeaderBytes)
+	n, _ := header.Marshal(packetData)
+	for i := 0; i < n; i++ {
+		if _, err := header.Unmarshal(packetData[:i]); err != ErrPacketTooSmall {
+			t.Error("Expected ErrPacketTooSmall reading", i, "bytes but got", err)
+		}
+	}
+
+	packetData[0] |= 1
+	if _, err := header.Unmarshal(packetData); err != ErrNotRegularPacket {
+		t.Error("Expected ErrNotRegularPacket but got", err)
+	}
+}
+
+func TestFragmentHeader(t *testing.T) {
+	packetHeader := PacketHeader{Sequence: 1000, Ack: 990, AckBits: 0xFFFF00FF}
+	packetData := make([]byte, FragmentHeaderBytes+MaxPacketHeaderBytes)
+
+	for _, fragmentId := range []int{0, 1, 15} {
+		writeHeader := FragmentHeader{Sequence: 1000, FragmentId: fragmentId, NumFragments: 16, Packet: packetHeader}
+		if fragmentId != 0 {
+			writeHeader.Packet = PacketHeader{}
+		}
+
+		bytesWritten, err := writeHeader.Marshal(packetData)
+		if err != nil || bytesWritten != writeHeader.Size() {
+			t.Fatal("Failed to write fragment header", fragmentId, err, bytesWritten)
+		}
+		if !IsFragment(packetData) {
+			t.Error("Fragment", fragmentId, "not recognized as a fragment")
+		}
+
+		var readHeader FragmentHeader
+		bytesRead, err := readHeader.Unmarshal(packetData[:bytesWritten])
+		if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+			t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
+		}
+	}
+
+	invalid := FragmentHeader{Sequence: 1000, FragmentId: 16, NumFragments: 16}
+	if _, err := invalid.Marshal(packetData); !errors.Is(err, ErrInvalidFragment) {
+		t.Error("Expected ErrInvalidFragment but got", err)
+	}
+
+	// first fragment whose packet header disagrees on the sequence
+	mismatch := FragmentHeader{Sequence: 1001, NumFragments: 2, Packet: packetHeader}
+	n, _ := mismatch.Marshal(packetData)
+	var readHeader FragmentHeader
+	if _, err := readHeader.Unmarshal(packetData[:n]); !errors.Is(err, ErrInvalidFragment) {
+		t.Error("Expected ErrInvalidFragment but got", err)
+	}
+
+	if _, err := readHeader.Unmarshal([]byte{0, 0, 0, 0, 0}); err != ErrNotFragment {
+		t.Error("Expected ErrNotFragment but got", err)
+	}
+}
@@ -0,0 +1,135 @@
+package rely
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	poolMinClassBits = 6
+	poolMaxClassBits = 24
+	poolNumClasses   = poolMaxClassBits - poolMinClassBits + 1
+)
+
+// Pool is an allocator for Config.Allocate and Config.Free that reuses buffers, so sending and receiving
+// do not create garbage. Buffers are grouped into power of two size classes from 64 bytes to 16MB, each
+// backed by a sync.Pool; bigger buffers are not reused. One Pool can be shared by any number of endpoints
+// and goroutines.
+type Pool struct {
+	maxBytes int64
+	inUse    int64
+	rejected uint64
+	// the counters stay ahead of the pools to keep them 64 bit aligned for atomic access
+	hits    [poolNumClasses]uint64
+	misses  [poolNumClasses]uint64
+	classes [poolNumClasses]sync.Pool
+	// slices holds the *[]byte the classes store buffers in, so that putting a buffer back does not allocate
+	slices sync.Pool
+	// big holds the buffers handed out that are bigger than the biggest class, by their first byte
+	big sync.Map
+}
+
+// PoolStats are the statistics of a Pool size class
+type PoolStats struct {
+	// Size is the capacity of the buffers in the class
+	Size int
+	// Hits is the number of allocations that reused a buffer
+	Hits uint64
+	// Misses is the number of allocations that had to make a new buffer
+	Misses uint64
+}
+
+// NewPool creates a pool that hands out at most maxBytes at once, counting buffers by capacity.
+// Allocate returns nil instead of going over. Zero means there is no limit.
+func NewPool(maxBytes int) *Pool {
+	return &Pool{maxBytes: int64(maxBytes)}
+}
+
+// poolClassOf returns the size class a buffer of size bytes goes in, or -1 if it is too big for any
+func poolClassOf(size int) int {
+	for class := 0; class < poolNumClasses; class++ {
+		if size <= 1<<(class+poolMinClassBits) {
+			return class
+		}
+	}
+	return -1
+}
+
+// Allocate returns a buffer of size bytes, or nil if that would go over the limit of the pool
+func (p *Pool) Allocate(size int) []byte {
+	class := poolClassOf(size)
+	capacity := size
+	if class >= 0 {
+		capacity = 1 << (class + poolMinClassBits)
+	}
+
+	if inUse := atomic.AddInt64(&p.inUse, int64(capacity)); p.maxBytes > 0 && inUse > p.maxBytes {
+		atomic.AddInt64(&p.inUse, -int64(capacity))
+		atomic.AddUint64(&p.rejected, 1)
+		return nil
+	}
+
+	if class < 0 {
+		data := make([]byte, size)
+		p.big.Store(&data[0], struct{}{})
+		return data
+	}
+
+	if ref, ok := p.classes[class].Get().(*[]byte); ok {
+		atomic.AddUint64(&p.hits[class], 1)
+		data := *ref
+		*ref = nil
+		p.slices.Put(ref)
+		return data[:size]
+	}
+	atomic.AddUint64(&p.misses[class], 1)
+	return make([]byte, size, capacity)
+}
+
+// Free returns a buffer from Allocate to the pool. Buffers the pool did not hand out are ignored, as far as
+// it can tell: a buffer of the capacity of a size class is taken to be its own.
+func (p *Pool) Free(data []byte) {
+	capacity := cap(data)
+	class := poolClassOf(capacity)
+	if class < 0 {
+		if _, ok := p.big.LoadAndDelete(&data[:1][0]); ok {
+			atomic.AddInt64(&p.inUse, -int64(capacity))
+		}
+		return
+	}
+	if capacity != 1<<(class+poolMinClassBits) {
+		// not from Allocate
+		return
+	}
+	atomic.AddInt64(&p.inUse, -int64(capacity))
+
+	ref, ok := p.slices.Get().(*[]byte)
+	if !ok {
+		ref = new([]byte)
+	}
+	*ref = data[:capacity]
+	p.classes[class].Put(ref)
+}
+
+// InUse returns the number of bytes handed out by Allocate and not yet freed
+func (p *Pool) InUse() int {
+	return int(atomic.LoadInt64(&p.inUse))
+}
+
+// Rejected returns the number of allocations refused because they would go over the limit of the pool
+func (p *Pool) Rejected() uint64 {
+	return atomic.LoadUint64(&p.rejected)
+}
+
+// Stats returns the statistics of every size class
+func (p *Pool) Stats() []PoolStats {
+	stats := make([]PoolStats, poolNumClasses)
+	for class := range p.classes {
+		stats[class] = PoolStats{
+			Size:   1 << (class + poolMinClassBits),
+			Hits:   atomic.LoadUint64(&p.hits[class]),
+			Misses: atomic.LoadUint64(&p.misses[class]),
+		}
+	}
+	return stats
+}
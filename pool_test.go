@@ -0,0 +1,237 @@
+package rely
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestPool(t *testing.T) {
+	pool := NewPool(0)
+
+	data := pool.Allocate(100)
+	if len(data) != 100 || cap(data) != 128 {
+		t.Fatal("Wrong buffer", len(data), cap(data))
+	}
+	if pool.InUse() != 128 {
+		t.Error("Expected 128 bytes in use, got", pool.InUse())
+	}
+	pool.Free(data)
+	if pool.InUse() != 0 {
+		t.Error("Expected nothing in use, got", pool.InUse())
+	}
+
+	data = pool.Allocate(65)
+	if len(data) != 65 || cap(data) != 128 {
+		t.Fatal("Wrong buffer", len(data), cap(data))
+	}
+	pool.Free(data)
+
+	stats := pool.Stats()
+	// sync.Pool may drop buffers at any time, so a hit is likely but not guaranteed
+	if stats[1].Size != 128 || stats[1].Hits+stats[1].Misses != 2 {
+		t.Error("Wrong stats", stats[1])
+	}
+
+	// buffers bigger than the biggest class are not reused, but still count
+	big := pool.Allocate(1<<poolMaxClassBits + 1)
+	if len(big) != 1<<poolMaxClassBits+1 || pool.InUse() != len(big) {
+		t.Error("Wrong big buffer", len(big), pool.InUse())
+	}
+	pool.Free(big)
+	if pool.InUse() != 0 {
+		t.Error("Expected nothing in use, got", pool.InUse())
+	}
+
+	// buffers that did not come from the pool are ignored
+	pool.Free(make([]byte, 100))
+	pool.Free(make([]byte, 1<<poolMaxClassBits+1))
+	pool.Free(big)
+	if pool.InUse() != 0 {
+		t.Error("Expected nothing in use, got", pool.InUse())
+	}
+}
+
+func TestPool_MaxBytes(t *testing.T) {
+	pool := NewPool(1024)
+
+	a := pool.Allocate(1000)
+	if a == nil {
+		t.Fatal("Allocation under the limit failed")
+	}
+	if b := pool.Allocate(1); b != nil || pool.Rejected() != 1 {
+		t.Error("Allocation over the limit succeeded", pool.Rejected())
+	}
+	pool.Free(a)
+	if b := pool.Allocate(1024); b == nil {
+		t.Error("Allocation under the limit failed after free")
+	}
+}
+
+func TestPool_Concurrent(t *testing.T) {
+	pool := NewPool(0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				data := pool.Allocate(64 << uint((i+j)%8))
+				data[0] = byte(i)
+				pool.Free(data)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if pool.InUse() != 0 {
+		t.Error("Expected nothing in use, got", pool.InUse())
+	}
+	var total uint64
+	for _, stats := range pool.Stats() {
+		total += stats.Hits + stats.Misses
+	}
+	if total != 8000 {
+		t.Error("Expected 8000 allocations, got", total)
+	}
+}
+
+func TestPool_Endpoint(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	pool := NewPool(8192)
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.Allocate = pool.Allocate
+		config.Free = pool.Free
+	})
+
+	for i := 0; i < 100; i++ {
+		context.sender.SendPacket(make([]byte, 100))
+		context.sender.SendPacket(make([]byte, 3000))
+	}
+	if context.receiver.PacketsReceived() != 200 || pool.InUse() != 0 {
+		t.Error("Packets were not received", context.receiver.PacketsReceived(), pool.InUse())
+	}
+
+	// too big to reassemble under the ceiling
+	context.sender.SendPacket(make([]byte, 5000))
+	if context.sender.AllocationsFailed() != 0 {
+		t.Error("Send of a fragmented packet should fit", context.sender.AllocationsFailed())
+	}
+	// each of the 5 fragments tries to start the reassembly
+	if context.receiver.AllocationsFailed() != 5 || pool.InUse() != 0 {
+		t.Error("Reassembly should not fit", context.receiver.AllocationsFailed(), pool.InUse())
+	}
+
+	// nothing left to send with, the packet is dropped without using up a sequence
+	held := pool.Allocate(8192)
+	context.sender.SendPacket(make([]byte, 100))
+	if context.sender.AllocationsFailed() != 1 || context.sender.NextPacketSequence() != 201 {
+		t.Error("Send should have failed", context.sender.AllocationsFailed(), context.sender.NextPacketSequence())
+	}
+	pool.Free(held)
+}
+
+func TestPool_LossyFragments(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	// room for a full reassembly buffer of 3 fragment packets, and no more
+	pool := NewPool(64 * 4096)
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+	sender, receiver := context.sender, context.receiver
+	receiver.allocate, receiver.free = pool.Allocate, pool.Free
+
+	// the last fragment of every packet is lost, so none complete
+	var fragments int
+	lossy := true
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		fragments++
+		if !lossy || fragments%3 != 0 {
+			receiver.ReceivePacket(packetData)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		sender.SendPacket(make([]byte, 3000))
+	}
+	if receiver.AllocationsFailed() != 0 || pool.InUse() != 64*4096 {
+		t.Fatal("Expected only the reassembly buffer to be in use, got", receiver.AllocationsFailed(), pool.InUse())
+	}
+
+	// complete packets push the rest out of the reassembly buffer
+	lossy = false
+	for i := 0; i < 64; i++ {
+		sender.SendPacket(make([]byte, 3000))
+	}
+	if receiver.AllocationsFailed() != 0 || pool.InUse() != 0 {
+		t.Error("Dropped reassemblies were not freed", receiver.AllocationsFailed(), pool.InUse())
+	}
+	// one 4096 byte buffer for each packet, at least 64 of them made for the full reassembly buffer
+	for _, stats := range pool.Stats() {
+		allocations := stats.Hits + stats.Misses
+		if stats.Size == 4096 && (allocations != 1064 || stats.Misses < 64) || stats.Size != 4096 && allocations != 0 {
+			t.Error("Unexpected allocations of", stats.Size, "bytes", stats.Hits, stats.Misses)
+		}
+	}
+
+	lossy = true
+	fragments = 0
+	sender.SendPacket(make([]byte, 3000))
+	receiver.Reset()
+	if pool.InUse() != 0 {
+		t.Error("Reset did not free the reassemblies", pool.InUse())
+	}
+}
+
+var benchmarkSink []byte
+
+func BenchmarkPool(b *testing.B) {
+	pool := NewPool(0)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pool.Free(pool.Allocate(1200))
+		}
+	})
+}
+
+func BenchmarkDefaultAllocate(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		var data []byte
+		for pb.Next() {
+			data = defaultAllocate(1200)
+			defaultFree(data)
+		}
+		benchmarkSink = data
+	})
+}
+
+func benchmarkEndpointAllocator(b *testing.B, allocate func(int) []byte, free func([]byte)) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.Allocate = allocate
+		config.Free = free
+	})
+	packetData := make([]byte, 3000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		context.sender.SendPacket(packetData)
+	}
+}
+
+func BenchmarkPool_Endpoint(b *testing.B) {
+	pool := NewPool(0)
+	benchmarkEndpointAllocator(b, pool.Allocate, pool.Free)
+}
+
+func BenchmarkDefaultAllocate_Endpoint(b *testing.B) {
+	benchmarkEndpointAllocator(b, nil, nil)
+}
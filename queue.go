@@ -0,0 +1,142 @@
+package rely
+
+import (
+	"container/heap"
+	"math"
+)
+
+const (
+	// sendBudgetHeadroom lets the derived budget grow past the acked bandwidth, which can only measure
+	// what was sent
+	sendBudgetHeadroom = 1.25
+	// sendBurstSeconds caps how much of the budget builds up while there is nothing to send
+	sendBurstSeconds = .1
+	// defaultMinSendBudgetKbps is used when Config.MinSendBudgetKbps is zero, so that the budget can start
+	defaultMinSendBudgetKbps = 256
+)
+
+// queuedPacket is a payload waiting in the send queue
+type queuedPacket struct {
+	data     []byte
+	priority int
+	deadline float64
+	order    uint64
+}
+
+// sendQueue orders queued packets by priority, highest first, and then by the order they were queued in
+type sendQueue []queuedPacket
+
+func (q sendQueue) Len() int { return len(q) }
+func (q sendQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].order < q[j].order
+}
+func (q sendQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *sendQueue) Push(x interface{}) { *q = append(*q, x.(queuedPacket)) }
+func (q *sendQueue) Pop() interface{} {
+	old := *q
+	packet := old[len(old)-1]
+	old[len(old)-1] = queuedPacket{}
+	*q = old[:len(old)-1]
+	return packet
+}
+
+// QueuePacket queues a packet for Update to send within the send budget, see Config.SendBudgetKbps. Packets
+// with a higher priority are sent first, and packets of the same priority in the order they were queued.
+// A packet still queued at the deadline, an endpoint time as passed to Update, is dropped instead of being
+// sent late. A deadline of zero means the packet waits for as long as it takes.
+func (e *Endpoint) QueuePacket(packetData []byte, priority int, deadline float64) {
+	if len(packetData) > e.config.MaxPacketSize {
+		e.counters[counterNumPacketsTooLargeToSend]++
+		return
+	}
+	data := e.allocate(len(packetData))
+	if data == nil {
+		log.Errorf("[%s] could not allocate %d bytes to queue packet", e.config.Name, len(packetData))
+		e.counters[counterNumAllocationsFailed]++
+		return
+	}
+	copy(data, packetData)
+	heap.Push(&e.sendQueue, queuedPacket{data: data, priority: priority, deadline: deadline, order: e.sendQueueOrder})
+	e.sendQueueOrder++
+}
+
+// sendBudget returns the bytes per second queued packets may be sent at
+func (e *Endpoint) sendBudget() float64 {
+	if e.config.CongestionController != nil {
+		return e.config.CongestionController.PacingRate() * 1000 / 8
+	}
+	if e.config.CongestionAvoidance {
+		return e.RecommendedSendRate() * 1000 / 8
+	}
+	if e.config.SendBudgetKbps > 0 {
+		return e.config.SendBudgetKbps * 1000 / 8
+	}
+	minimum := e.config.MinSendBudgetKbps
+	if minimum == 0 {
+		minimum = defaultMinSendBudgetKbps
+	}
+	return math.Max(e.ackedBandwidthKbps*sendBudgetHeadroom, minimum) * 1000 / 8
+}
+
+// flushSendQueue drops the queued packets that are past their deadline and sends the rest for as long as
+// the budget and the congestion window allow. The budget may be overdrawn by the last packet sent, so that
+// packets bigger than the burst still go out, and is paid back before the next one.
+func (e *Endpoint) flushSendQueue() {
+	budget := e.sendBudget()
+	e.sendTokens += (e.time - e.lastFlushTime) * budget
+	e.lastFlushTime = e.time
+	if burst := budget * sendBurstSeconds; e.sendTokens > burst {
+		e.sendTokens = burst
+	}
+	if len(e.sendQueue) == 0 {
+		return
+	}
+
+	expired := false
+	kept := e.sendQueue[:0]
+	for _, packet := range e.sendQueue {
+		if packet.deadline != 0 && packet.deadline < e.time {
+			debugf("[%s] dropping queued packet with priority %d, %.3f seconds past its deadline", e.config.Name, packet.priority, e.time-packet.deadline)
+			e.counters[counterNumPacketsExpired]++
+			e.free(packet.data)
+			expired = true
+			continue
+		}
+		kept = append(kept, packet)
+	}
+	if expired {
+		for i := len(kept); i < len(e.sendQueue); i++ {
+			e.sendQueue[i] = queuedPacket{}
+		}
+		e.sendQueue = kept
+		heap.Init(&e.sendQueue)
+	}
+
+	for len(e.sendQueue) > 0 && e.sendTokens > 0 && e.congestionWindowOpen() {
+		packet := heap.Pop(&e.sendQueue).(queuedPacket)
+		sequence := e.sequence
+		e.SendPacket(packet.data)
+		if sequence != e.sequence {
+			e.sendTokens -= float64(e.sentPackets.Find(sequence).PacketBytes)
+		}
+		e.free(packet.data)
+	}
+}
+
+// resetSendQueue frees all queued packets
+func (e *Endpoint) resetSendQueue() {
+	for i, packet := range e.sendQueue {
+		e.free(packet.data)
+		e.sendQueue[i] = queuedPacket{}
+	}
+	e.sendQueue = e.sendQueue[:0]
+	e.sendTokens = 0
+}
+
+// QueuedPackets returns the number of packets waiting in the send queue
+func (e *Endpoint) QueuedPackets() int {
+	return len(e.sendQueue)
+}
@@ -0,0 +1,91 @@
+package rely
+
+import (
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestQueuePacket(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		// 10000 bytes per second, so a burst of 1000 bytes
+		config.SendBudgetKbps = 80
+	})
+	sender, receiver := context.sender, context.receiver
+	pool := NewPool(0)
+	sender.allocate, sender.free = pool.Allocate, pool.Free
+
+	var processed []byte
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) bool {
+		processed = append(processed, packetData[0])
+		return true
+	}
+	packet := func(id byte, size int) []byte {
+		packetData := make([]byte, size)
+		packetData[0] = id
+		return packetData
+	}
+
+	sender.QueuePacket(packet(1, 500), 0, 0)
+	sender.QueuePacket(packet(2, 500), 0, 0)
+	sender.QueuePacket(packet(3, 100), 1, 0)
+	sender.QueuePacket(packet(4, 500), 0, 0)
+	if sender.PacketsSent() != 0 || sender.QueuedPackets() != 4 {
+		t.Fatal("Expected packets to wait for Update", sender.PacketsSent(), sender.QueuedPackets())
+	}
+
+	// the high priority packet goes first, then the budget runs out after overdrawing it
+	sender.Update(100.1)
+	if string(processed) != "\x03\x01\x02" || sender.QueuedPackets() != 1 {
+		t.Fatal("Expected packets 3, 1 and 2, got", processed, sender.QueuedPackets())
+	}
+	// the overdraft is paid back first
+	sender.Update(100.101)
+	if len(processed) != 3 {
+		t.Error("Expected the budget to be overdrawn, sent", processed)
+	}
+	sender.Update(100.2)
+	if string(processed) != "\x03\x01\x02\x04" || sender.QueuedPackets() != 0 {
+		t.Error("Expected packet 4, got", processed, sender.QueuedPackets())
+	}
+
+	// expired packets are dropped rather than sent late
+	sender.QueuePacket(packet(5, 100), 0, 100.25)
+	sender.QueuePacket(packet(6, 100), 0, 100.5)
+	sender.QueuePacket(packet(7, 100), 0, 0)
+	sender.Update(100.3)
+	if string(processed[4:]) != "\x06\x07" || sender.PacketsExpired() != 1 {
+		t.Error("Expected packet 5 to expire, got", processed[4:], sender.PacketsExpired())
+	}
+
+	sender.QueuePacket(packet(8, 100), 0, 0)
+	sender.Reset()
+	if sender.QueuedPackets() != 0 || pool.InUse() != 0 {
+		t.Error("Reset did not free the queue", sender.QueuedPackets(), pool.InUse())
+	}
+}
+
+func TestSendBudget(t *testing.T) {
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+	sender := context.sender
+
+	if budget := sender.sendBudget(); budget != 256*1000/8 {
+		t.Error("Expected the minimum budget before anything was acked, got", budget)
+	}
+	sender.config.MinSendBudgetKbps = 0
+	if budget := sender.sendBudget(); budget != defaultMinSendBudgetKbps*1000/8 {
+		t.Error("Expected the default minimum budget without one configured, got", budget)
+	}
+	sender.ackedBandwidthKbps = 1000
+	if budget := sender.sendBudget(); budget != 1000*sendBudgetHeadroom*1000/8 {
+		t.Error("Expected the budget to follow the acked bandwidth, got", budget)
+	}
+	sender.config.SendBudgetKbps = 100
+	if budget := sender.sendBudget(); budget != 100*1000/8 {
+		t.Error("Expected the configured budget, got", budget)
+	}
+}
@@ -0,0 +1,6 @@
+//+build race
+
+package rely
+
+// raceEnabled is set when testing with the race detector, which allocates on its own
+const raceEnabled = true
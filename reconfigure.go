@@ -0,0 +1,96 @@
+package rely
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ErrUnsafeReconfigure is wrapped by the errors Reconfigure returns for changes a running endpoint cannot make
+var ErrUnsafeReconfigure = fmt.Errorf("%w: change needs a new endpoint", ErrInvalidConfig)
+
+// Reconfigure switches a running endpoint to a new config without losing its sequence and ack state.
+// Buffers are resized to the new sizes, keeping the entries that still fit, and held packets are delivered
+// right away when the jitter buffer or ordered delivery is turned off or resized. A new
+// CongestionController starts with nothing in flight, so packets sent before it are neither acked nor lost
+// to it. Changes to the wire format, fragment layout or ExtendedSequences are rejected, and so is an
+// invalid config; the endpoint keeps its old config when an error is returned. Pass a changed copy of the
+// config, since changes are found by comparing against the config the endpoint is using.
+func (e *Endpoint) Reconfigure(config *Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	old := e.config
+	switch {
+	case config.ReliableIOCompatible != old.ReliableIOCompatible:
+		return fmt.Errorf("%w: ReliableIOCompatible changes the wire format", ErrUnsafeReconfigure)
+	case config.ProtocolId != old.ProtocolId || config.ProtocolVersion != old.ProtocolVersion:
+		return fmt.Errorf("%w: ProtocolId and ProtocolVersion must match the peer", ErrUnsafeReconfigure)
+	case config.Checksum != old.Checksum:
+		return fmt.Errorf("%w: Checksum must match the peer", ErrUnsafeReconfigure)
+	case config.FragmentSize != old.FragmentSize || config.MaxFragments != old.MaxFragments:
+		return fmt.Errorf("%w: FragmentSize and MaxFragments size packets being reassembled", ErrUnsafeReconfigure)
+	case config.ExtendedSequences != old.ExtendedSequences:
+		return fmt.Errorf("%w: ExtendedSequences cannot be changed", ErrUnsafeReconfigure)
+	}
+
+	if config.JitterBuffer != old.JitterBuffer || config.OrderedDelivery != old.OrderedDelivery ||
+		config.ReceivedPacketsBufferSize != old.ReceivedPacketsBufferSize {
+		// held packets are delivered rather than lost
+		e.deliverHeldPackets(e.jitter.held.Sequence)
+		e.resetJitterBuffer()
+		if config.ReceivedPacketsBufferSize != old.ReceivedPacketsBufferSize {
+			e.jitter = newJitterBuffer(config.ReceivedPacketsBufferSize)
+		}
+	}
+	if config.CongestionAvoidance != old.CongestionAvoidance {
+		e.congestion = newCongestionAvoidance(e.time)
+	}
+	if !sameController(config.CongestionController, old.CongestionController) {
+		// the new controller was not told about the packets in flight, so they are no longer tracked
+		e.resetInFlight()
+	}
+	if config.SentPacketsBufferSize < old.SentPacketsBufferSize && old.CongestionController != nil {
+		// packets that no longer fit are lost if they are still in flight
+		e.detectLosses(e.sequence-uint16(config.SentPacketsBufferSize), e.time-e.lossTimeout())
+	}
+	if config.SentPacketsBufferSize != old.SentPacketsBufferSize {
+		e.sentPackets = e.sentPackets.Resize(config.SentPacketsBufferSize)
+	}
+	if config.ReceivedPacketsBufferSize != old.ReceivedPacketsBufferSize {
+		e.receivedPackets = e.receivedPackets.Resize(config.ReceivedPacketsBufferSize)
+	}
+	if config.FragmentReassemblyBufferSize != old.FragmentReassemblyBufferSize {
+		resized := e.fragmentReassembly.Resize(config.FragmentReassemblyBufferSize)
+		for i := 0; i < e.fragmentReassembly.NumEntries; i++ {
+			reassemblyData := e.fragmentReassembly.AtIndex(i)
+			if reassemblyData != nil && resized.Find(reassemblyData.Sequence) == nil {
+				e.freeReassembly(reassemblyData)
+			}
+		}
+		e.fragmentReassembly = resized
+	}
+	if config.AckBufferSize != old.AckBufferSize {
+		acks := make([]uint16, 0, config.AckBufferSize)
+		if len(e.acks) >= config.AckBufferSize {
+			// keep the most recent acks
+			e.acks = e.acks[len(e.acks)-config.AckBufferSize+1:]
+		}
+		e.acks = append(acks, e.acks...)
+	}
+
+	e.config = config
+	e.trailerBytes = config.trailerBytes()
+	e.ackWindow = config.ackWindow()
+	e.trimRedundantPayloads()
+	e.initStats()
+	return nil
+}
+
+// sameController returns true if both controllers are nil or the same controller
+func sameController(a, b CongestionController) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || !reflect.TypeOf(a).Comparable() {
+		return a == nil && b == nil
+	}
+	return a == b
+}
@@ -0,0 +1,167 @@
+package rely
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestEndpoint_Reconfigure(t *testing.T) {
+	logging.SetLevel(logging.ERROR, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+
+	for i := 0; i < 200; i++ {
+		context.sender.SendPacket([]byte{1, 2, 3})
+	}
+
+	// shrink the received buffer below what it holds, then grow it again
+	config := *context.receiver.config
+	config.ReceivedPacketsBufferSize = 64
+	config.RttSmoothingFactor = .5
+	if err := context.receiver.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if context.receiver.config.RttSmoothingFactor != .5 {
+		t.Error("Smoothing factor was not applied")
+	}
+	for sequence := uint16(0); sequence < 200; sequence++ {
+		if exists := context.receiver.receivedPackets.Exists(sequence); exists != (sequence >= 200-64) {
+			t.Error("Packet", sequence, "exists", exists, "after shrinking")
+		}
+	}
+	config.ReceivedPacketsBufferSize = 512
+	if err := context.receiver.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if !context.receiver.receivedPackets.Exists(199) || !context.receiver.receivedPackets.Exists(136) || context.receiver.receivedPackets.Exists(135) {
+		t.Error("Entries lost after growing")
+	}
+	if context.receiver.receivedPackets.Sequence != 200 {
+		t.Error("Sequence lost after resizing", context.receiver.receivedPackets.Sequence)
+	}
+
+	// the sender keeps acking and measuring across a resize of its sent buffer
+	senderConfig := *context.sender.config
+	senderConfig.SentPacketsBufferSize = 1024
+	senderConfig.AckWindow = 64
+	if err := context.sender.Reconfigure(&senderConfig); err != nil {
+		t.Fatal(err)
+	}
+	context.receiver.SendPacket([]byte{1, 2, 3})
+	if acks := context.sender.GetAcks(); len(acks) != 32 || acks[0] != 199 {
+		t.Error("Acks after resizing", acks)
+	}
+	context.sender.SendPacket([]byte{1, 2, 3})
+	if context.sender.NextPacketSequence() != 201 || context.sender.sentPackets.Find(200) == nil || context.sender.sentPackets.Find(199) == nil {
+		t.Error("Sent packets lost after resizing")
+	}
+
+	// partially reassembled packets that no longer fit are freed
+	var freed int
+	context.receiver.free = func(_ []byte) { freed++ }
+	context.drop = 0
+	var fragments [][]byte
+	context.sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		fragments = append(fragments, append([]byte(nil), packetData...))
+	}
+	for i := 0; i < 4; i++ {
+		fragments = fragments[:0]
+		context.sender.SendPacket(make([]byte, 3000))
+		context.receiver.ReceivePacket(fragments[0])
+	}
+	smaller := config
+	smaller.FragmentReassemblyBufferSize = 2
+	if err := context.receiver.Reconfigure(&smaller); err != nil {
+		t.Fatal(err)
+	}
+	if freed != 2 {
+		t.Error("Expected 2 reassembly buffers freed, got", freed)
+	}
+
+	unsafe := []func(config *Config){
+		func(c *Config) { c.FragmentSize = 512 },
+		func(c *Config) { c.MaxFragments = 32 },
+		func(c *Config) { c.Checksum = true },
+		func(c *Config) { c.ProtocolId = 1 },
+		func(c *Config) { c.ExtendedSequences = true },
+		func(c *Config) { c.SentPacketsBufferSize = 0 },
+	}
+	for i, configure := range unsafe {
+		changed := *context.sender.config
+		configure(&changed)
+		if err := context.sender.Reconfigure(&changed); !errors.Is(err, ErrInvalidConfig) {
+			t.Error("Change", i, "should be rejected, got", err)
+		}
+		if context.sender.config != &senderConfig {
+			t.Error("Config changed after rejection")
+		}
+	}
+
+	// the allocator stays the one the endpoint was created with
+	changed := *context.receiver.config
+	allocated := 0
+	changed.Allocate = func(size int) []byte {
+		allocated++
+		return make([]byte, size)
+	}
+	changed.Free = func([]byte) {}
+	if err := context.receiver.Reconfigure(&changed); err != nil {
+		t.Fatal(err)
+	}
+	received := context.receiver.PacketsReceived()
+	fragments = fragments[:0]
+	context.sender.SendPacket(make([]byte, 3000))
+	for _, fragment := range fragments {
+		context.receiver.ReceivePacket(fragment)
+	}
+	if context.receiver.PacketsReceived() != received+1 || allocated != 0 {
+		t.Error("Expected the allocator change to be ignored, got", allocated, "allocations")
+	}
+}
+
+func TestEndpoint_ReconfigureController(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.CongestionController = &testController{window: 1000}
+	})
+	sender, receiver := context.sender, context.receiver
+
+	context.drop = 1
+	for i := 0; i < 3; i++ {
+		sender.SendPacket(make([]byte, 100))
+	}
+	context.drop = 0
+
+	// without a controller nothing is in flight
+	config := *sender.config
+	config.CongestionController = nil
+	if err := sender.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	if sender.BytesInFlight() != 0 {
+		t.Error("Expected nothing in flight without a controller, got", sender.BytesInFlight())
+	}
+
+	// a new controller is only told about the packets sent after it
+	context.drop = 1
+	sender.SendPacket(make([]byte, 100))
+	context.drop = 0
+	controller := &testController{window: 1000}
+	config.CongestionController = controller
+	if err := sender.Reconfigure(&config); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		sender.SendPacket(make([]byte, 100))
+	}
+	receiver.SendPacket(nil)
+	sender.Update(110)
+	if controller.sent != 4 || controller.acked != 4 || controller.lost != 0 || sender.BytesInFlight() != 0 {
+		t.Error("Expected only the packets sent after the change, got", controller.sent, controller.acked, controller.lost, sender.BytesInFlight())
+	}
+}
@@ -0,0 +1,156 @@
+package rely
+
+import (
+	"fmt"
+)
+
+// With Config.RedundantPayloads, regular packets carry copies of the most recent payloads that have not
+// been acked yet, so a payload gets through as long as any of the packets carrying it does. The packet
+// header sets flagRedundant, and the payload is preceded by:
+//
+//	[count (uint8)] count * ([sequence (uint16)] [payload bytes (uint16)] [payload])
+//
+// The copies are in sequence order, oldest first.
+const (
+	redundantBlockHeaderBytes = 1
+	redundantEntryHeaderBytes = 4
+	maxRedundantPayloads      = 255
+)
+
+// redundantPayload is a copy of a recently sent payload
+type redundantPayload struct {
+	sequence uint16
+	data     []byte
+}
+
+// redundantPayloads returns how many recent payloads to resend, none when keeping to the reliable.io wire format
+func (c *Config) redundantPayloads() int {
+	if c.ReliableIOCompatible {
+		return 0
+	}
+	return c.RedundantPayloads
+}
+
+// trimRedundantPayloads frees the copies of payloads that were acked or are too old to be acked, and the
+// oldest ones beyond Config.RedundantPayloads
+func (e *Endpoint) trimRedundantPayloads() {
+	kept := e.redundant[:0]
+	for i, payload := range e.redundant {
+		sentPacketData := e.sentPackets.Find(payload.sequence)
+		if sentPacketData == nil || sentPacketData.Acked != 0 || len(e.redundant)-i > e.config.redundantPayloads() {
+			e.free(payload.data)
+			continue
+		}
+		kept = append(kept, payload)
+	}
+	for i := len(kept); i < len(e.redundant); i++ {
+		e.redundant[i] = redundantPayload{}
+	}
+	e.redundant = kept
+}
+
+// redundantBlock returns how many of the most recent payloads fit in a regular packet along with a
+// payload of packetBytes, and the bytes they take up
+func (e *Endpoint) redundantBlock(packetBytes int) (count, blockBytes int) {
+	if packetBytes > e.config.FragmentAbove {
+		return 0, 0
+	}
+	blockBytes = redundantBlockHeaderBytes
+	for i := len(e.redundant) - 1; i >= 0; i-- {
+		entryBytes := redundantEntryHeaderBytes + len(e.redundant[i].data)
+		if packetBytes+blockBytes+entryBytes > e.config.FragmentAbove {
+			break
+		}
+		blockBytes += entryBytes
+		count++
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return count, blockBytes
+}
+
+// writeRedundantBlock writes the most recent count payloads
+func (e *Endpoint) writeRedundantBlock(p *buffer, count int) {
+	p.writeUint8(uint8(count))
+	for _, payload := range e.redundant[len(e.redundant)-count:] {
+		p.writeUint16(payload.sequence)
+		p.writeUint16(uint16(len(payload.data)))
+		p.writeBytes(payload.data)
+	}
+}
+
+// keepRedundantPayload keeps a copy of a sent payload to resend with the next packets
+func (e *Endpoint) keepRedundantPayload(sequence uint16, packetData []byte) {
+	if len(packetData) == 0 || len(packetData)+redundantEntryHeaderBytes+redundantBlockHeaderBytes > e.config.FragmentAbove {
+		// nothing to resend, or it could never fit in another packet
+		return
+	}
+	data := e.allocate(len(packetData))
+	if data == nil {
+		log.Errorf("[%s] could not allocate %d bytes to keep payload %d for resending", e.config.Name, len(packetData), sequence)
+		e.counters[counterNumAllocationsFailed]++
+		return
+	}
+	copy(data, packetData)
+	e.redundant = append(e.redundant, redundantPayload{sequence: sequence, data: data})
+	e.trimRedundantPayloads()
+}
+
+// resetRedundantPayloads frees all kept payloads
+func (e *Endpoint) resetRedundantPayloads() {
+	for i, payload := range e.redundant {
+		e.free(payload.data)
+		e.redundant[i] = redundantPayload{}
+	}
+	e.redundant = e.redundant[:0]
+}
+
+// readRedundantPayloads checks the copies of earlier payloads carried by the packet with the sequence, and
+// returns the payload of the packet itself
+func readRedundantPayloads(sequence uint16, packetData []byte) ([]byte, error) {
+	if len(packetData) < redundantBlockHeaderBytes {
+		return nil, fmt.Errorf("redundant block: %w", ErrPacketTooSmall)
+	}
+	p := buffer{buf: packetData}
+	count, _ := p.getUint8()
+	for i := 0; i < int(count); i++ {
+		if len(packetData)-p.pos < redundantEntryHeaderBytes {
+			return nil, fmt.Errorf("redundant payload %d of %d: %w", i, count, ErrPacketTooSmall)
+		}
+		redundantSequence, _ := p.getUint16()
+		payloadBytes, _ := p.getUint16()
+		if !SequenceLessThan(redundantSequence, sequence) {
+			return nil, fmt.Errorf("redundant payload %d is not older than packet %d", redundantSequence, sequence)
+		}
+		if _, err := p.getBytes(int(payloadBytes)); err != nil {
+			return nil, fmt.Errorf("redundant payload %d: %w", redundantSequence, ErrPacketTooSmall)
+		}
+	}
+	return packetData[p.pos:], nil
+}
+
+// processRedundantPayloads processes the copies of earlier payloads in a block checked by
+// readRedundantPayloads, skipping the ones that were already received
+func (e *Endpoint) processRedundantPayloads(sequence uint16, packetData []byte) {
+	p := buffer{buf: packetData}
+	count, _ := p.getUint8()
+	for i := 0; i < int(count); i++ {
+		redundantSequence, _ := p.getUint16()
+		payloadBytes, _ := p.getUint16()
+		data, _ := p.getBytes(int(payloadBytes))
+		if !e.receivedPackets.TestInsert(redundantSequence) || e.receivedPackets.Exists(redundantSequence) {
+			continue
+		}
+
+		debugf("[%s] processing redundant payload %d from packet %d", e.config.Name, redundantSequence, sequence)
+		if e.processPacket(redundantSequence, data) {
+			e.counters[counterNumRedundantPayloadsDelivered]++
+			e.slideReceivedStats(redundantSequence)
+			receivedPacketData := e.receivedPackets.Insert(redundantSequence)
+			receivedPacketData.Time = e.time
+			// the bytes were counted with the packet that carried them
+			receivedPacketData.PacketBytes = 0
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package rely
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+func TestRedundantPayloads(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.RedundantPayloads = 3
+	})
+	sender, receiver := context.sender, context.receiver
+	pool := NewPool(0)
+	sender.allocate, sender.free = pool.Allocate, pool.Free
+
+	var sent [][]byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+	}
+	var processed []uint16
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, sequence uint16, packetData []byte) bool {
+		if !bytes.Equal(packetData, []byte{byte(sequence), 1, 2}) {
+			t.Error("Payload of packet", sequence, "does not match", packetData)
+		}
+		processed = append(processed, sequence)
+		return true
+	}
+	redundant := func(packetData []byte) bool {
+		var header PacketHeader
+		if _, err := header.Unmarshal(packetData); err != nil {
+			t.Fatal(err)
+		}
+		return header.Redundant
+	}
+
+	// packets 1 and 2 are lost, their payloads arrive with packet 3
+	for i := 0; i < 5; i++ {
+		sender.SendPacket([]byte{byte(i), 1, 2})
+	}
+	if redundant(sent[0]) || !redundant(sent[1]) {
+		t.Error("Expected copies in every packet after the first")
+	}
+	receiver.ReceivePacket(sent[0])
+	receiver.ReceivePacket(sent[3])
+	receiver.ReceivePacket(sent[4])
+	receiver.ReceivePacket(sent[1])
+	if len(processed) != 5 {
+		t.Fatal("Expected 5 payloads processed once each, got", processed)
+	}
+	for i, sequence := range processed {
+		if sequence != uint16(i) {
+			t.Fatal("Expected payloads in order, got", processed)
+		}
+	}
+	if receiver.RedundantPayloadsDelivered() != 2 || receiver.PacketsDuplicate() != 1 {
+		t.Error("Expected 2 payloads from copies and 1 duplicate, got", receiver.RedundantPayloadsDelivered(), receiver.PacketsDuplicate())
+	}
+
+	// acked payloads are no longer sent
+	receiver.SendPacket(nil)
+	sender.SendPacket([]byte{5, 1, 2})
+	if redundant(sent[5]) || len(sender.redundant) != 1 {
+		t.Error("Expected acked payloads to be dropped, have", len(sender.redundant))
+	}
+
+	// copies are limited by count and by FragmentAbove
+	for i := 6; i < 10; i++ {
+		sender.SendPacket([]byte{byte(i), 1, 2})
+	}
+	if len(sender.redundant) != 3 {
+		t.Error("Expected 3 copies, have", len(sender.redundant))
+	}
+	sender.config.FragmentAbove = 12
+	sender.SendPacket([]byte{10, 1, 2})
+	var header PacketHeader
+	headerBytes, _ := header.Unmarshal(sent[10])
+	if count := sent[10][headerBytes]; count != 1 {
+		t.Error("Expected one copy to fit, got", count)
+	}
+
+	sender.Reset()
+	if pool.InUse() != 0 {
+		t.Error("Reset did not free the copies", pool.InUse())
+	}
+}
+
+func TestRedundantPayloads_Invalid(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+	receiver := context.receiver
+
+	for _, block := range [][]byte{
+		{},
+		{1, 0},
+		{1, 0, 0, 5, 0, 1},
+		{1, 5, 0, 1, 0, 1},
+	} {
+		if _, err := readRedundantPayloads(5, block); err == nil {
+			t.Error("Expected an error for", block)
+		}
+	}
+	block := []byte{1, 4, 0, 1, 0, 9, 7}
+	payload, err := readRedundantPayloads(5, block)
+	receiver.processRedundantPayloads(5, block)
+	if err != nil || !bytes.Equal(payload, []byte{7}) || receiver.RedundantPayloadsDelivered() != 1 {
+		t.Error("Expected payload 7 after one copy, got", payload, err)
+	}
+}
+
+func TestRedundantPayloads_InvalidPacket(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.RedundantPayloads = 3
+		config.Compressor, _ = NewFlateCompressor(flate.DefaultCompression, nil)
+	})
+	sender, receiver := context.sender, context.receiver
+	receiver.config.Compressor = nil
+
+	var sent [][]byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+	}
+	sender.SendPacket([]byte{0, 1, 2})
+	sender.SendPacket([]byte{1, 1, 2})
+	sender.SendPacket(bytes.Repeat([]byte{1, 2, 3, 4}, 100))
+	var header PacketHeader
+	if _, err := header.Unmarshal(sent[2]); err != nil || !header.Redundant || !header.Compressed {
+		t.Fatal("Expected a compressed packet carrying redundant payloads", header, err)
+	}
+
+	// the receiver cannot decompress the packet, so none of it is processed
+	receiver.ReceivePacket(sent[2])
+	if receiver.counters[counterNumPacketsInvalid] != 1 || receiver.RedundantPayloadsDelivered() != 0 || receiver.receivedPackets.Exists(0) {
+		t.Error("Expected the packet to be invalid without delivering its redundant payloads", receiver.counters[counterNumPacketsInvalid], receiver.RedundantPayloadsDelivered())
+	}
+}
@@ -2,6 +2,7 @@
 package rely
 
 import (
+	"fmt"
 	"github.com/op/go-logging"
 	"math"
 )
@@ -19,10 +20,38 @@ type Endpoint struct {
 	ackedBandwidthKbps    float64
 	acks                  []uint16
 	sequence              uint16
-	sentPackets           *sentPacketSequenceBuffer
-	receivedPackets       *receivedPacketSequenceBuffer
-	fragmentReassembly    *fragmentSequenceBuffer
+	extendedSequence      uint64
+	receivedSequence      uint64
+	staleRun              int
+	staleSequence         uint16
+	lastSequenceTime      float64
+	sentPackets           *SequenceBuffer[sentPacketData]
+	receivedPackets       *SequenceBuffer[receivedPacketData]
+	fragmentReassembly    *SequenceBuffer[fragmentReassemblyData]
 	counters              [counterMax]uint64
+	trailerBytes          int
+	ackWindow             int
+	lastSendTime          float64
+	lastReceiveTime       float64
+	timedOut              bool
+	lossWindow            windowStats
+	sentWindow            windowStats
+	receivedWindow        windowStats
+	ackedWindow           windowStats
+	baseline              uint64
+	baselineSequence      uint16
+	hasBaseline           bool
+	jitter                jitterBuffer
+	redundant             []redundantPayload
+	sendQueue             sendQueue
+	sendQueueOrder        uint64
+	sendTokens            float64
+	lastFlushTime         float64
+	congestion            congestionAvoidance
+	bytesInFlight         int
+	lossSequence          uint16
+	largestAcked          uint16
+	hasLargestAcked       bool
 
 	allocate func(int) []byte
 	free     func([]byte)
@@ -33,12 +62,20 @@ func NewEndpoint(config *Config, time float64) *Endpoint {
 	endpoint := &Endpoint{
 		config:             config,
 		time:               time,
-		sentPackets:        newSentPacketSequenceBuffer(config.SentPacketsBufferSize),
-		receivedPackets:    newReceivedPacketSequenceBuffer(config.ReceivedPacketsBufferSize),
-		fragmentReassembly: newFragmentSequenceBuffer(config.FragmentReassemblyBufferSize),
+		lastSendTime:       time,
+		lastReceiveTime:    time,
+		lastFlushTime:      time,
+		lastSequenceTime:   time,
+		sentPackets:        NewSequenceBuffer[sentPacketData](config.SentPacketsBufferSize),
+		receivedPackets:    NewSequenceBuffer[receivedPacketData](config.ReceivedPacketsBufferSize),
+		fragmentReassembly: NewSequenceBuffer[fragmentReassemblyData](config.FragmentReassemblyBufferSize),
 		acks:               make([]uint16, 0, config.AckBufferSize),
 		allocate:           config.Allocate,
 		free:               config.Free,
+		trailerBytes:       config.trailerBytes(),
+		ackWindow:          config.ackWindow(),
+		jitter:             newJitterBuffer(config.ReceivedPacketsBufferSize),
+		congestion:         newCongestionAvoidance(time),
 	}
 	if endpoint.allocate == nil {
 		endpoint.allocate = defaultAllocate
@@ -46,10 +83,19 @@ func NewEndpoint(config *Config, time float64) *Endpoint {
 	if endpoint.free == nil {
 		endpoint.free = defaultFree
 	}
+	endpoint.initStats()
 
 	return endpoint
 }
 
+// NewValidatedEndpoint creates an endpoint, or returns the error from Config.Validate
+func NewValidatedEndpoint(config *Config, time float64) (*Endpoint, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return NewEndpoint(config, time), nil
+}
+
 func defaultAllocate(size int) []byte {
 	return make([]byte, size)
 }
@@ -68,51 +114,89 @@ func (e *Endpoint) SendPacket(packetData []byte) {
 		return
 	}
 
+	payload := packetData
+	var compressed []byte
+	if e.config.compressor() != nil {
+		packetData, compressed = e.compressPayload(packetData)
+		packetBytes = len(packetData)
+	}
+
+	var redundantCount, redundantBytes int
+	if e.config.redundantPayloads() > 0 {
+		e.trimRedundantPayloads()
+		redundantCount, redundantBytes = e.redundantBlock(packetBytes)
+	}
+
+	transmitBufferSize := packetBytes + redundantBytes + MaxPacketHeaderBytes + e.trailerBytes
+	if packetBytes > e.config.FragmentAbove {
+		transmitBufferSize = FragmentHeaderBytes + MaxPacketHeaderBytes + e.config.FragmentSize + e.trailerBytes
+		if e.config.fragmentRedundancy() > 0 {
+			transmitBufferSize += parityHeaderBytes - FragmentHeaderBytes
+		}
+	}
+	transmitPacketData := e.allocate(transmitBufferSize)
+	if transmitPacketData == nil {
+		log.Errorf("[%s] could not allocate %d bytes to send packet", e.config.Name, transmitBufferSize)
+		e.counters[counterNumAllocationsFailed]++
+		if compressed != nil {
+			e.free(compressed)
+		}
+		return
+	}
+
 	sequence := e.sequence
 	e.sequence++
+	e.extendedSequence++
+	e.lastSendTime = e.time
 	var ack uint16
-	var ackBits uint32
+	var ackBits uint64
 
-	e.receivedPackets.GenerateAckBits(&ack, &ackBits)
+	e.receivedPackets.GenerateWideAckBits(&ack, &ackBits, e.ackWindow)
+	e.slideSentStats(sequence)
+	if e.config.CongestionController != nil {
+		// the packet about to leave the buffer is lost if it is still in flight
+		e.detectLosses(sequence-uint16(e.sentPackets.NumEntries)+1, e.time-e.lossTimeout())
+	}
 	sentPacketData := e.sentPackets.Insert(sequence)
 	sentPacketData.Time = e.time
-	sentPacketData.PacketBytes = uint32(e.config.PacketHeaderSize + packetBytes)
+	sentPacketData.PacketBytes = uint32(e.config.PacketHeaderSize + redundantBytes + packetBytes)
 	sentPacketData.Acked = 0
+	if e.config.CongestionController != nil {
+		e.trackInFlight(sentPacketData)
+	}
+
+	header := PacketHeader{Sequence: sequence, Ack: ack, AckBits: ackBits, Redundant: redundantCount > 0, Compressed: compressed != nil}
 
 	if packetBytes <= e.config.FragmentAbove {
 		// regular packet
 		debugf("[%s] sending packet %d without fragmentation", e.config.Name, sequence)
-		transmitPacketData := newBufferFromRef(e.allocate(packetBytes + MaxPacketHeaderBytes))
-		_ = writePacketHeader(transmitPacketData, sequence, ack, ackBits)
-		transmitPacketData.writeBytes(packetData)
-		e.config.TransmitPacketFunction(e.config.Context, e.config.Index, sequence, transmitPacketData.bytes())
-		e.free(transmitPacketData.buf)
+		p := buffer{buf: transmitPacketData}
+		p.pos, _ = header.Marshal(transmitPacketData)
+		if redundantCount > 0 {
+			e.writeRedundantBlock(&p, redundantCount)
+		}
+		p.writeBytes(packetData)
+		e.transmitPacket(sequence, p.bytes())
+		if e.config.redundantPayloads() > 0 {
+			e.keepRedundantPayload(sequence, payload)
+		}
 	} else {
 		// fragment packet
-		packetHeader := newBufferFromRef(e.allocate(MaxPacketHeaderBytes))
-		_ = writePacketHeader(packetHeader, sequence, ack, ackBits)
 		var extra int
 		if packetBytes%e.config.FragmentSize != 0 {
 			extra = 1
 		}
 		numFragments := (packetBytes / e.config.FragmentSize) + extra
 		debugf("[%s] sending packet %d as %d fragments", e.config.Name, sequence, numFragments)
-		fragmentBufferSize := FragmentHeaderBytes + MaxPacketHeaderBytes + e.config.FragmentSize
-
-		q := newBufferFromRef(packetData)
-		p := newBufferFromRef(e.allocate(fragmentBufferSize))
+		q := buffer{buf: packetData}
+		p := buffer{buf: transmitPacketData}
+		fragmentHeader := FragmentHeader{Sequence: sequence, NumFragments: numFragments, Packet: header}
 
 		// write each fragment with header and data
 		for fragmentId := 0; fragmentId < numFragments; fragmentId++ {
+			fragmentHeader.FragmentId = fragmentId
 			p.reset()
-			p.writeUint8(1)
-			p.writeUint16(sequence)
-			p.writeUint8(uint8(fragmentId))
-			p.writeUint8(uint8(numFragments - 1))
-
-			if fragmentId == 0 {
-				p.writeBytes(packetHeader.bytes())
-			}
+			p.pos, _ = fragmentHeader.Marshal(p.buf)
 
 			bytesToCopy := e.config.FragmentSize
 			if q.pos+bytesToCopy > len(packetData) {
@@ -121,107 +205,148 @@ func (e *Endpoint) SendPacket(packetData []byte) {
 			b, _ := q.getBytes(bytesToCopy)
 			p.writeBytes(b)
 
-			e.config.TransmitPacketFunction(e.config.Context, e.config.Index, sequence, p.bytes())
+			e.transmitPacket(sequence, p.bytes())
 			e.counters[counterNumFragmentsSent]++
 		}
-		e.free(p.buf)
-		e.free(packetHeader.buf)
+
+		if e.config.fragmentRedundancy() > 0 {
+			e.sendParityFragments(header, packetData, transmitPacketData, numFragments)
+		}
+	}
+	e.free(transmitPacketData)
+	if compressed != nil {
+		e.free(compressed)
 	}
 	e.counters[counterNumPacketsSent]++
 }
 
 // ReceivePacket reliably receives a packet of data sent by SendPacket
 func (e *Endpoint) ReceivePacket(packetData []byte) {
+	packetData, ok := e.readTrailer(packetData)
+	if !ok {
+		return
+	}
+	e.receivePacket(packetData)
+}
+
+// receivePacket receives a datagram without its trailer, or a reassembled packet
+func (e *Endpoint) receivePacket(packetData []byte) {
 	if len(packetData) > e.config.MaxPacketSize {
 		log.Errorf("[%s] packet too large to receive. packet is %d bytes, maximum is %d", e.config.Name, len(packetData), e.config.MaxPacketSize)
 		e.counters[counterNumPacketsTooLargeToReceive]++
 		return
 	}
 
+	if len(packetData) == 0 {
+		log.Errorf("[%s] ignoring empty packet", e.config.Name)
+		e.counters[counterNumPacketsInvalid]++
+		return
+	}
+
 	prefixByte := packetData[0]
 	if (prefixByte & 1) == 0 {
 		// normal packet
-		e.counters[counterNumPacketsReceived]++
-
-		var sequence, ack uint16
-		var ackBits uint32
+		var header PacketHeader
+		packetHeaderBytes, err := header.Unmarshal(packetData)
+		if err == nil && header.AckOnly {
+			debugf("[%s] received ack-only packet", e.config.Name)
+			e.lastReceiveTime = e.time
+			e.counters[counterNumAcksReceived]++
+			e.processAcks(header.Ack, header.AckBits)
+			return
+		}
 
-		packetHeaderBytes := readPacketHeader(e.config.Name, packetData, &sequence, &ack, &ackBits)
-		if packetHeaderBytes < 0 {
-			log.Errorf("[%s] ignoring invalid packet. could not read packet header", e.config.Name)
+		e.counters[counterNumPacketsReceived]++
+		if err != nil {
+			log.Errorf("[%s] ignoring invalid packet. could not read packet header: %v", e.config.Name, err)
 			e.counters[counterNumPacketsInvalid]++
 			return
 		}
-
-		if !e.receivedPackets.TestInsert(sequence) {
+		e.lastReceiveTime = e.time
+		sequence, ack, ackBits := header.Sequence, header.Ack, header.AckBits
+
+		if e.config.ExtendedSequences {
+			extendedSequence, ok := e.extendReceivedSequence(sequence)
+			if !ok {
+				log.Errorf("[%s] ignoring stale packet %d", e.config.Name, extendedSequence)
+				e.counters[counterNumPacketsStale]++
+				return
+			}
+			if extendedSequence >= e.receivedSequence {
+				e.receivedSequence = extendedSequence + 1
+			}
+		} else if !e.receivedPackets.TestInsert(sequence) {
 			log.Errorf("[%s] ignoring stale packet %d", e.config.Name, sequence)
 			e.counters[counterNumPacketsStale]++
 			return
 		}
 
+		if e.receivedPackets.Exists(sequence) {
+			debugf("[%s] ignoring duplicate packet %d", e.config.Name, sequence)
+			e.counters[counterNumPacketsDuplicate]++
+			return
+		}
+
+		// the whole packet is read before any of it is processed
+		payload := packetData[packetHeaderBytes:]
+		if header.Redundant {
+			payload, err = readRedundantPayloads(sequence, payload)
+			if err != nil {
+				log.Errorf("[%s] ignoring invalid packet. could not read redundant payloads: %v", e.config.Name, err)
+				e.counters[counterNumPacketsInvalid]++
+				return
+			}
+		}
+
+		var decompressed []byte
+		if header.Compressed {
+			payload, decompressed, err = e.decompressPayload(payload)
+			if err != nil {
+				log.Errorf("[%s] ignoring invalid packet. could not decompress packet %d: %v", e.config.Name, sequence, err)
+				e.counters[counterNumPacketsInvalid]++
+				return
+			}
+		}
+		if header.Redundant {
+			e.processRedundantPayloads(sequence, packetData[packetHeaderBytes:])
+		}
+
 		debugf("[%s] processing packet %d", e.config.Name, sequence)
-		if e.config.ProcessPacketFunction(e.config.Context, e.config.Index, sequence, packetData[packetHeaderBytes:]) {
+		if e.processPacket(sequence, payload) {
 			debugf("[%s] process packet %d successful", e.config.Name, sequence)
+			e.slideReceivedStats(sequence)
 			receivedPacketData := e.receivedPackets.Insert(sequence)
 			receivedPacketData.Time = e.time
 			receivedPacketData.PacketBytes = uint32(e.config.PacketHeaderSize + len(packetData))
 
-			for i := 0; i < 32; i++ {
-				if ackBits&1 != 0 {
-					ackSequence := ack - uint16(i)
-					sentPacketData := e.sentPackets.Find(ackSequence)
-					if sentPacketData != nil && sentPacketData.Acked == 0 && len(e.acks)+1 < e.config.AckBufferSize {
-						debugf("[%s] acked packet %d", e.config.Name, ackSequence)
-						e.acks = append(e.acks, ackSequence)
-						e.counters[counterNumPacketsAcked]++
-						sentPacketData.Acked = 1
-
-						rtt := (e.time - sentPacketData.Time) * 1000
-						if e.rtt == 0 && rtt > 0 || math.Abs(e.rtt-rtt) < 0.00001 {
-							e.rtt = rtt
-						} else {
-							e.rtt += (rtt - e.rtt) * e.config.RttSmoothingFactor
-						}
-					}
-				}
-				ackBits >>= 1
-			}
+			e.processAcks(ack, ackBits)
+		}
+		if decompressed != nil {
+			e.free(decompressed)
 		}
+	} else if isParity(packetData) && !e.config.ReliableIOCompatible {
+		e.receiveParityFragment(packetData)
 	} else {
 		// fragment packet
-		var fragmentId, numFragments, fragmentBytes int
-		var sequence, ack uint16
-		var ackBits uint32
-
-		fragHeaderBytes := readFragmentHeader(e.config.Name, packetData, e.config.MaxFragments, e.config.FragmentSize, &fragmentId, &numFragments, &fragmentBytes, &sequence, &ack, &ackBits)
-		if fragHeaderBytes < 0 {
-			log.Errorf("[%s] ignoring invalid fragment. could not read fragment header", e.config.Name)
+		var header FragmentHeader
+		fragHeaderBytes, err := e.readFragmentHeader(packetData, &header)
+		if err != nil {
+			log.Errorf("[%s] ignoring invalid fragment. could not read fragment header: %v", e.config.Name, err)
 			e.counters[counterNumFragmentsInvalid]++
 			return
 		}
+		e.lastReceiveTime = e.time
+		sequence, fragmentId, numFragments := header.Sequence, header.FragmentId, header.NumFragments
 
-		reassemblyData := e.fragmentReassembly.Find(sequence)
-		if reassemblyData == nil {
-			reassemblyData = e.fragmentReassembly.Insert(sequence)
-			if reassemblyData == nil {
-				log.Errorf("[%s] ignoring invalid fragment. could not insert in reassembly buffer (stale)", e.config.Name)
-				e.counters[counterNumFragmentsInvalid]++
-				return
-			}
-
-			packetBufferSize := MaxPacketHeaderBytes + numFragments*e.config.FragmentSize
-			reassemblyData.Sequence = sequence
-			reassemblyData.Ack = 0
-			reassemblyData.AckBits = 0
-			reassemblyData.NumFragmentsReceived = 0
-			reassemblyData.NumFragmentsTotal = numFragments
-			reassemblyData.PacketData = e.allocate(packetBufferSize)
-			reassemblyData.FragmentReceived = [256]uint8{}
+		if e.receivedPackets.Exists(sequence) {
+			// a duplicate of a fragment of a packet that was already reassembled would start reassembling it again
+			debugf("[%s] ignoring fragment %d of duplicate packet %d", e.config.Name, fragmentId, sequence)
+			e.counters[counterNumPacketsDuplicate]++
+			return
 		}
 
-		if numFragments != reassemblyData.NumFragmentsTotal {
-			log.Errorf("[%s] ignoring invalid fragment. fragment count mismatch. expected %d, got %d", e.config.Name, reassemblyData.NumFragmentsTotal, numFragments)
-			e.counters[counterNumFragmentsInvalid]++
+		reassemblyData := e.findReassembly(sequence, numFragments)
+		if reassemblyData == nil {
 			return
 		}
 
@@ -233,17 +358,163 @@ func (e *Endpoint) ReceivePacket(packetData []byte) {
 		debugf("[%s] received fragment %d of packet %d (%d/%d)", e.config.Name, fragmentId, sequence, reassemblyData.NumFragmentsReceived+1, numFragments)
 		reassemblyData.NumFragmentsReceived++
 		reassemblyData.FragmentReceived[fragmentId] = 1
-		reassemblyData.StoreFragmentData(sequence, ack, ackBits, fragmentId, e.config.FragmentSize, packetData[fragHeaderBytes:])
+		reassemblyData.StoreFragmentData(&header, e.config.FragmentSize, packetData[fragHeaderBytes:])
+		if reassemblyData.NumParityGroups > 0 {
+			e.recoverFragment(reassemblyData, fragmentId%reassemblyData.NumParityGroups)
+		}
+		e.completeReassembly(reassemblyData)
 
-		if reassemblyData.NumFragmentsReceived == reassemblyData.NumFragmentsTotal {
-			debugf("[%s] completed reassembly of packet %d", e.config.Name, sequence)
-			e.ReceivePacket(reassemblyData.PacketData[MaxPacketHeaderBytes-reassemblyData.PacketHeaderBytes : MaxPacketHeaderBytes+reassemblyData.PacketBytes])
-			e.free(reassemblyData.PacketData)
+		e.counters[counterNumFragmentsReceived]++
+	}
+}
+
+// findReassembly returns the reassembly data of a fragmented packet, starting its reassembly if this
+// is the first fragment to arrive. It returns nil if the fragment should be ignored.
+func (e *Endpoint) findReassembly(sequence uint16, numFragments int) *fragmentReassemblyData {
+	reassemblyData := e.fragmentReassembly.Find(sequence)
+	if reassemblyData == nil {
+		reassemblyData = e.insertReassembly(sequence)
+		if reassemblyData == nil && e.config.ExtendedSequences && !e.receivedPackets.TestInsert(sequence) {
+			// the peer may have moved on after a long stall, unless the fragment is merely too old to reassemble
+			if _, ok := e.extendReceivedSequence(sequence); ok {
+				reassemblyData = e.insertReassembly(sequence)
+			}
+		}
+		if reassemblyData == nil {
+			log.Errorf("[%s] ignoring invalid fragment. could not insert in reassembly buffer (stale)", e.config.Name)
+			e.counters[counterNumFragmentsInvalid]++
+			return nil
+		}
+
+		packetBufferSize := MaxPacketHeaderBytes + numFragments*e.config.FragmentSize
+		reassemblyData.PacketData = e.allocate(packetBufferSize)
+		if reassemblyData.PacketData == nil {
+			log.Errorf("[%s] ignoring fragment. could not allocate %d bytes to reassemble packet %d", e.config.Name, packetBufferSize, sequence)
+			e.counters[counterNumAllocationsFailed]++
 			e.fragmentReassembly.Remove(sequence)
+			return nil
 		}
+		reassemblyData.Sequence = sequence
+		reassemblyData.Ack = 0
+		reassemblyData.AckBits = 0
+		reassemblyData.NumFragmentsReceived = 0
+		reassemblyData.NumFragmentsTotal = numFragments
+		reassemblyData.FragmentReceived = [256]uint8{}
+	}
 
-		e.counters[counterNumFragmentsReceived]++
+	if numFragments != reassemblyData.NumFragmentsTotal {
+		log.Errorf("[%s] ignoring invalid fragment. fragment count mismatch. expected %d, got %d", e.config.Name, reassemblyData.NumFragmentsTotal, numFragments)
+		e.counters[counterNumFragmentsInvalid]++
+		return nil
+	}
+	return reassemblyData
+}
+
+// insertReassembly inserts the sequence in the reassembly buffer, freeing the packets still being reassembled
+// that the insert drops from the buffer
+func (e *Endpoint) insertReassembly(sequence uint16) *fragmentReassemblyData {
+	sb := e.fragmentReassembly
+	if sb.TestInsert(sequence) && SequenceGreaterThan(sequence+1, sb.Sequence) {
+		// the same entries RemoveEntries empties
+		start, finish := int(sb.Sequence), int(sequence)
+		if finish < start {
+			finish += 65536
+		}
+		if finish-start >= sb.NumEntries {
+			start, finish = 0, sb.NumEntries-1
+		}
+		for i := start; i <= finish; i++ {
+			if reassemblyData := sb.AtIndex(i % sb.NumEntries); reassemblyData != nil {
+				e.freeReassembly(reassemblyData)
+			}
+		}
+	}
+	return sb.Insert(sequence)
+}
+
+// completeReassembly receives the packet once all of its fragments are in
+func (e *Endpoint) completeReassembly(reassemblyData *fragmentReassemblyData) {
+	if reassemblyData.NumFragmentsReceived != reassemblyData.NumFragmentsTotal {
+		return
+	}
+	debugf("[%s] completed reassembly of packet %d", e.config.Name, reassemblyData.Sequence)
+	if reassemblyData.NumFragmentsRecovered > 0 {
+		e.counters[counterNumPacketsRecovered]++
+	}
+	e.receivePacket(reassemblyData.PacketData[MaxPacketHeaderBytes-reassemblyData.PacketHeaderBytes : MaxPacketHeaderBytes+reassemblyData.PacketBytes])
+	e.freeReassembly(reassemblyData)
+	e.fragmentReassembly.Remove(reassemblyData.Sequence)
+}
+
+// freeReassembly frees the buffers of a packet being reassembled
+func (e *Endpoint) freeReassembly(reassemblyData *fragmentReassemblyData) {
+	if reassemblyData.PacketData != nil {
+		e.free(reassemblyData.PacketData)
+		reassemblyData.PacketData = nil
 	}
+	if reassemblyData.ParityData != nil {
+		e.free(reassemblyData.ParityData)
+		reassemblyData.ParityData = nil
+	}
+}
+
+// processAcks marks the sent packets acked by a received packet, and updates the RTT
+func (e *Endpoint) processAcks(ack uint16, ackBits uint64) {
+	for i := 0; i < 64; i++ {
+		if ackBits&1 != 0 {
+			ackSequence := ack - uint16(i)
+			sentPacketData := e.sentPackets.Find(ackSequence)
+			if sentPacketData != nil && sentPacketData.Acked == 0 && len(e.acks)+1 < e.config.AckBufferSize {
+				debugf("[%s] acked packet %d", e.config.Name, ackSequence)
+				e.acks = append(e.acks, ackSequence)
+				e.counters[counterNumPacketsAcked]++
+				sentPacketData.Acked = 1
+				e.ackStats(ackSequence)
+				e.ackBaseline(ackSequence, sentPacketData)
+
+				rtt := (e.time - sentPacketData.Time) * 1000
+				if e.rtt == 0 && rtt > 0 || math.Abs(e.rtt-rtt) < 0.00001 {
+					e.rtt = rtt
+				} else {
+					e.rtt += (rtt - e.rtt) * e.config.RttSmoothingFactor
+				}
+				if e.config.CongestionController != nil {
+					e.ackInFlight(ackSequence, sentPacketData, rtt)
+				}
+			}
+		}
+		ackBits >>= 1
+	}
+	if e.config.CongestionController != nil {
+		e.detectAckedLosses()
+	}
+}
+
+// SendAck sends a packet carrying only acks. It does not use up a sequence and is not acked in turn,
+// so it does not show up in the peer's loss or bandwidth statistics. When Config.ReliableIOCompatible
+// is set it sends an empty packet instead, since reliable.io has no ack-only packets.
+func (e *Endpoint) SendAck() {
+	if e.config.ReliableIOCompatible {
+		e.SendPacket(nil)
+		return
+	}
+
+	header := PacketHeader{Sequence: e.sequence, AckOnly: true}
+	e.receivedPackets.GenerateWideAckBits(&header.Ack, &header.AckBits, e.ackWindow)
+	e.lastSendTime = e.time
+
+	transmitPacketData := e.allocate(MaxPacketHeaderBytes + e.trailerBytes)
+	if transmitPacketData == nil {
+		log.Errorf("[%s] could not allocate %d bytes to send ack", e.config.Name, MaxPacketHeaderBytes+e.trailerBytes)
+		e.counters[counterNumAllocationsFailed]++
+		return
+	}
+
+	debugf("[%s] sending ack-only packet", e.config.Name)
+	headerBytes, _ := header.Marshal(transmitPacketData)
+	e.transmitPacket(header.Sequence, transmitPacketData[:headerBytes])
+	e.free(transmitPacketData)
+	e.counters[counterNumAcksSent]++
 }
 
 // GetAcks returns the acks received so far, make sure to clear acks too
@@ -260,36 +531,71 @@ func (e *Endpoint) ClearAcks() {
 func (e *Endpoint) Reset() {
 	e.ClearAcks()
 	e.sequence = 0
+	e.extendedSequence = 0
+	e.receivedSequence = 0
+	e.staleRun = 0
+	e.lastSequenceTime = e.time
+	e.hasBaseline = false
+	e.lastSendTime = e.time
+	e.lastReceiveTime = e.time
+	e.timedOut = false
+
+	e.resetFragmentReassembly()
+	e.resetJitterBuffer()
+	e.resetRedundantPayloads()
+	e.resetSendQueue()
+	e.congestion = newCongestionAvoidance(e.time)
+	e.resetInFlight()
+	e.sentPackets.Reset()
+	e.receivedPackets.Reset()
+	e.invalidateStats()
+}
 
+// resetFragmentReassembly frees any partially reassembled packets and empties the reassembly buffer
+func (e *Endpoint) resetFragmentReassembly() {
 	for i := 0; i < e.config.FragmentReassemblyBufferSize; i++ {
-		reassemblyData := e.fragmentReassembly.AtIndex(i)
-
-		if reassemblyData != nil && reassemblyData.PacketData != nil {
-			reassemblyData.PacketData = nil
+		if reassemblyData := e.fragmentReassembly.AtIndex(i); reassemblyData != nil {
+			e.freeReassembly(reassemblyData)
 		}
 	}
 
-	e.sentPackets.Reset()
-	e.receivedPackets.Reset()
 	e.fragmentReassembly.Reset()
 }
 
-// Update recalculates statistics (like packet loss)
+// Update recalculates statistics (like packet loss), switches congestion modes, sends queued packets within
+// the send budget, sends a keepalive if one is due, checks for timeout, and delivers the packets in the
+// jitter buffer that are due
 func (e *Endpoint) Update(time float64) {
 	e.time = time
 
+	if e.config.Timeout > 0 && !e.timedOut && e.TimeSinceLastReceive() >= e.config.Timeout {
+		log.Errorf("[%s] timed out. nothing received for %.2f seconds", e.config.Name, e.TimeSinceLastReceive())
+		e.timedOut = true
+		if e.config.OnTimeout != nil {
+			e.config.OnTimeout(e.config.Context, e.config.Index)
+		}
+	}
+
+	e.updateCongestion()
+	if e.config.CongestionController != nil {
+		e.detectLosses(e.lossSequence, e.time-e.lossTimeout())
+	}
+	e.flushSendQueue()
+
+	if e.config.KeepaliveInterval > 0 && e.time-e.lastSendTime >= e.config.KeepaliveInterval {
+		e.SendAck()
+	}
+
+	e.releaseHeldPackets()
+
+	sentStart := e.sentPackets.Sequence - uint16(e.sentPackets.NumEntries)
+	receivedStart := e.receivedPackets.Sequence - uint16(e.receivedPackets.NumEntries)
+
 	// calculate packet loss
 	{
-		baseSequence := (e.sentPackets.Sequence - uint16(e.config.SentPacketsBufferSize) + 1) + 0xFFFF
-		var numDropped int
+		e.lossWindow.sync(sentStart)
+		numDropped := e.lossWindow.count
 		numSamples := e.config.SentPacketsBufferSize / 2
-		for i := 0; i < numSamples; i++ {
-			sequence := baseSequence + uint16(i)
-			sentPacketData := e.sentPackets.Find(sequence)
-			if sentPacketData != nil && sentPacketData.Acked == 0 {
-				numDropped++
-			}
-		}
 		packetLoss := float64(numDropped) / float64(numSamples) * 100
 		if math.Abs(e.packetLoss-packetLoss) > 0.00001 {
 			e.packetLoss += (packetLoss - e.packetLoss) * e.config.PacketLossSmoothingFactor
@@ -300,25 +606,9 @@ func (e *Endpoint) Update(time float64) {
 
 	// calculate sent bandwidth
 	{
-		baseSequence := (int(e.sentPackets.Sequence) - e.config.SentPacketsBufferSize + 1) + 0xFFFF
-		var bytesSent int
-		startTime := math.MaxFloat64
-		var finishTime float64
-		numSamples := e.config.SentPacketsBufferSize / 2
-		for i := 0; i < numSamples; i++ {
-			sequence := uint16(baseSequence + i)
-			sentPacketData := e.sentPackets.Find(sequence)
-			if sentPacketData == nil {
-				continue
-			}
-			bytesSent += int(sentPacketData.PacketBytes)
-			if sentPacketData.Time < startTime {
-				startTime = sentPacketData.Time
-			}
-			if sentPacketData.Time > finishTime {
-				finishTime = sentPacketData.Time
-			}
-		}
+		e.sentWindow.sync(sentStart)
+		bytesSent := e.sentWindow.bytes
+		startTime, finishTime := e.sentWindow.timeRange()
 		if startTime != math.MaxFloat64 && finishTime != 0 {
 			sentBandwidthKbps := float64(bytesSent) / (finishTime - startTime) * 8 / 1000
 			if math.Abs(sentBandwidthKbps-sentBandwidthKbps) > 0.00001 {
@@ -331,25 +621,9 @@ func (e *Endpoint) Update(time float64) {
 
 	// calculate received bandwidth
 	{
-		baseSequence := (int(e.receivedPackets.Sequence) - e.config.ReceivedPacketsBufferSize + 1) + 0xFFFF
-		var bytesSent int
-		startTime := math.MaxFloat64
-		var finishTime float64
-		numSamples := e.config.ReceivedPacketsBufferSize / 2
-		for i := 0; i < numSamples; i++ {
-			sequence := uint16(baseSequence + i)
-			receivedPacketData := e.receivedPackets.Find(sequence)
-			if receivedPacketData == nil {
-				continue
-			}
-			bytesSent += int(receivedPacketData.PacketBytes)
-			if receivedPacketData.Time < startTime {
-				startTime = receivedPacketData.Time
-			}
-			if receivedPacketData.Time > finishTime {
-				finishTime = receivedPacketData.Time
-			}
-		}
+		e.receivedWindow.sync(receivedStart)
+		bytesSent := e.receivedWindow.bytes
+		startTime, finishTime := e.receivedWindow.timeRange()
 		if startTime != math.MaxFloat64 && finishTime != 0 {
 			receivedBandwidthKbps := float64(bytesSent) / (finishTime - startTime) * 8 / 1000
 			if math.Abs(e.receivedBandwidthKbps-receivedBandwidthKbps) > 0.00001 {
@@ -362,25 +636,9 @@ func (e *Endpoint) Update(time float64) {
 
 	// calculate acked bandwidth
 	{
-		baseSequence := (int(e.sentPackets.Sequence) - e.config.SentPacketsBufferSize + 1) + 0xFFFF
-		var bytesSent int
-		startTime := math.MaxFloat64
-		var finishTime float64
-		numSamples := e.config.ReceivedPacketsBufferSize / 2
-		for i := 0; i < numSamples; i++ {
-			sequence := uint16(baseSequence + i)
-			sentPacketData := e.sentPackets.Find(sequence)
-			if sentPacketData == nil || sentPacketData.Acked == 0 {
-				continue
-			}
-			bytesSent += int(sentPacketData.PacketBytes)
-			if sentPacketData.Time < startTime {
-				startTime = sentPacketData.Time
-			}
-			if sentPacketData.Time > finishTime {
-				finishTime = sentPacketData.Time
-			}
-		}
+		e.ackedWindow.sync(sentStart)
+		bytesSent := e.ackedWindow.bytes
+		startTime, finishTime := e.ackedWindow.timeRange()
 		if startTime != math.MaxFloat64 && finishTime != 0 {
 			ackedBandwidthKbps := float64(bytesSent) / (finishTime - startTime) * 8 / 1000
 			if math.Abs(e.ackedBandwidthKbps-ackedBandwidthKbps) > 0.00001 {
@@ -407,213 +665,121 @@ func (e *Endpoint) PacketsAcked() uint64 {
 	return e.counters[counterNumPacketsAcked]
 }
 
-// Rtt returns the round-trip time
-func (e *Endpoint) Rtt() float64 {
-	return e.rtt
+// PacketsWrongProtocol returns the number of datagrams rejected for having a different protocol id or version
+func (e *Endpoint) PacketsWrongProtocol() uint64 {
+	return e.counters[counterNumPacketsWrongProtocol]
 }
 
-// PacketLoss returns the percent of packets lost this endpoint is experiencing
-func (e *Endpoint) PacketLoss() float64 {
-	return e.packetLoss
+// PacketsCorrupt returns the number of datagrams dropped because their checksum did not match
+func (e *Endpoint) PacketsCorrupt() uint64 {
+	return e.counters[counterNumPacketsCorrupt]
 }
 
-// Bandwith returns the sent, received, and acked bandwidth in Kbps
-func (e *Endpoint) Bandwidth() (float64, float64, float64) {
-	return e.sentBandwidthKbps, e.receivedBandwidthKbps, e.ackedBandwidthKbps
+// AcksSent returns the number of ack-only packets sent
+func (e *Endpoint) AcksSent() uint64 {
+	return e.counters[counterNumAcksSent]
 }
 
-func writePacketHeader(packetData *buffer, sequence, ack uint16, ackBits uint32) int {
-	var prefixByte uint8
-
-	if (ackBits & 0x000000FF) != 0x000000FF {
-		prefixByte |= 1 << 1
-	}
-
-	if (ackBits & 0x0000FF00) != 0x0000FF00 {
-		prefixByte |= 1 << 2
-	}
-
-	if (ackBits & 0x00FF0000) != 0x00FF0000 {
-		prefixByte |= 1 << 3
-	}
-
-	if (ackBits & 0xFF000000) != 0xFF000000 {
-		prefixByte |= 1 << 4
-	}
-
-	seqDiff := int(sequence - ack)
-	if seqDiff < 0 {
-		seqDiff += 65536
-	}
-	if seqDiff <= 255 {
-		prefixByte |= 1 << 5
-	}
-
-	packetData.writeUint8(prefixByte)
-	packetData.writeUint16(sequence)
+// AcksReceived returns the number of ack-only packets received
+func (e *Endpoint) AcksReceived() uint64 {
+	return e.counters[counterNumAcksReceived]
+}
 
-	if seqDiff <= 255 {
-		packetData.writeUint8(uint8(seqDiff))
-	} else {
-		packetData.writeUint16(ack)
-	}
+// TimedOut reports whether nothing was received for Config.Timeout seconds. It stays set until Reset.
+func (e *Endpoint) TimedOut() bool {
+	return e.timedOut
+}
 
-	if (ackBits & 0x000000FF) != 0x000000FF {
-		packetData.writeUint8(uint8(ackBits & 0x000000FF))
-	}
-	if (ackBits & 0x0000FF00) != 0x0000FF00 {
-		packetData.writeUint8(uint8(ackBits & 0x000000FF >> 8))
-	}
-	if (ackBits & 0x00FF0000) != 0x00FF0000 {
-		packetData.writeUint8(uint8(ackBits & 0x00FF0000 >> 16))
-	}
-	if (ackBits & 0xFF000000) != 0xFF000000 {
-		packetData.writeUint8(uint8(ackBits & 0xFF000000 >> 24))
-	}
+// TimeSinceLastReceive returns the seconds since the last valid packet was received, as of the last Update
+func (e *Endpoint) TimeSinceLastReceive() float64 {
+	return e.time - e.lastReceiveTime
+}
 
-	return packetData.pos
+// AllocationsFailed returns the number of packets and fragments dropped because Config.Allocate returned nil
+func (e *Endpoint) AllocationsFailed() uint64 {
+	return e.counters[counterNumAllocationsFailed]
 }
 
-func readPacketHeader(name string, packetData []byte, sequence, ack *uint16, ackBits *uint32) int {
-	packetBytes := len(packetData)
-	if packetBytes < 3 {
-		return -1
-	}
-	p := newBufferFromRef(packetData)
+// PacketsLate returns the number of packets dropped by the jitter buffer or ordered delivery because they
+// arrived after a later packet was delivered
+func (e *Endpoint) PacketsLate() uint64 {
+	return e.counters[counterNumPacketsLate]
+}
 
-	prefixByte, _ := p.getUint8()
+// PacketsReordered returns the number of packets that arrived after a later packet, while the jitter
+// buffer or ordered delivery is enabled
+func (e *Endpoint) PacketsReordered() uint64 {
+	return e.counters[counterNumPacketsReordered]
+}
 
-	if (prefixByte & 1) != 0 {
-		log.Errorf("[%s] prefix byte does not indicate a regular packet", name)
-		return -1
-	}
+// PacketsSkipped returns the number of sequences the jitter buffer or ordered delivery gave up waiting for
+func (e *Endpoint) PacketsSkipped() uint64 {
+	return e.counters[counterNumPacketsSkipped]
+}
 
-	*sequence, _ = p.getUint16()
-	if prefixByte&(1<<5) != 0 {
-		if packetBytes < 3+1 {
-			log.Errorf("[%s] packet too small for packet header (2)", name)
-			return -1
-		}
-		sequenceDifference, _ := p.getUint8()
-		*ack = *sequence - uint16(sequenceDifference)
-	} else {
-		if packetBytes < 3+2 {
-			log.Errorf("[%s] packet too small for packet header (3)", name)
-			return -1
-		}
-		*ack, _ = p.getUint16()
-	}
+// PacketsDuplicate returns the number of packets and fragments dropped because their packet was already received
+func (e *Endpoint) PacketsDuplicate() uint64 {
+	return e.counters[counterNumPacketsDuplicate]
+}
 
-	var expectedBytes int
-	var i uint
-	for i = 1; i <= 4; i++ {
-		if prefixByte&(1<<i) != 0 {
-			expectedBytes++
-		}
-	}
-	if packetBytes < p.pos+expectedBytes {
-		log.Errorf("[%s] packet too small for packet header (4)", name)
-		return -1
-	}
+// PacketsRecovered returns the number of fragmented packets completed by rebuilding lost fragments from
+// parity, see Config.FragmentRedundancy
+func (e *Endpoint) PacketsRecovered() uint64 {
+	return e.counters[counterNumPacketsRecovered]
+}
 
-	*ackBits = 0xFFFFFFFF
-	if prefixByte&(1<<1) != 0 {
-		*ackBits &= 0xFFFFFF00
-		b, _ := p.getUint8()
-		*ackBits |= uint32(b)
-	}
-	if prefixByte&(1<<2) != 0 {
-		*ackBits &= 0xFFFF00FF
-		b, _ := p.getUint8()
-		*ackBits |= uint32(b) << 8
-	}
-	if prefixByte&(1<<3) != 0 {
-		*ackBits &= 0xFF00FFFF
-		b, _ := p.getUint8()
-		*ackBits |= uint32(b) << 16
-	}
-	if prefixByte&(1<<4) != 0 {
-		*ackBits &= 0x00FFFFFF
-		b, _ := p.getUint8()
-		*ackBits |= uint32(b) << 24
-	}
+// RedundantPayloadsDelivered returns the number of payloads processed from the copies carried by later
+// packets, because their own packet was lost or had yet to arrive, see Config.RedundantPayloads
+func (e *Endpoint) RedundantPayloadsDelivered() uint64 {
+	return e.counters[counterNumRedundantPayloadsDelivered]
+}
 
-	return p.pos
+// PacketsCompressed returns the number of packets sent with a compressed payload, see Config.Compressor
+func (e *Endpoint) PacketsCompressed() uint64 {
+	return e.counters[counterNumPacketsCompressed]
 }
 
-func readFragmentHeader(name string, packetData []byte, maxFragments, fragmentSize int, fragmentId, numFragments, fragmentBytes *int, sequence, ack *uint16, ackBits *uint32) int {
-	packetBytes := len(packetData)
-	if packetBytes < FragmentHeaderBytes {
-		log.Errorf("[%s] packet is too small to read fragment header", name)
-		return -1
-	}
+// PacketsExpired returns the number of queued packets dropped because their deadline passed, see QueuePacket
+func (e *Endpoint) PacketsExpired() uint64 {
+	return e.counters[counterNumPacketsExpired]
+}
 
-	p := newBufferFromRef(packetData)
-	prefixByte, _ := p.getUint8()
-	if prefixByte != 1 {
-		log.Errorf("[%s] prefix byte is not a fragment", name)
-		return -1
-	}
+// Rtt returns the round-trip time
+func (e *Endpoint) Rtt() float64 {
+	return e.rtt
+}
 
-	*sequence, _ = p.getUint16()
-	tmp, _ := p.getUint8()
-	*fragmentId = int(tmp)
-	tmp, _ = p.getUint8()
-	*numFragments = int(tmp) + 1
+// PacketLoss returns the percent of packets lost this endpoint is experiencing
+func (e *Endpoint) PacketLoss() float64 {
+	return e.packetLoss
+}
 
-	if *numFragments > maxFragments {
-		log.Errorf("[%s] num fragments %d outside of range of max fragments %d", name, *numFragments, maxFragments)
-		return -1
-	}
+// Bandwith returns the sent, received, and acked bandwidth in Kbps
+func (e *Endpoint) Bandwidth() (float64, float64, float64) {
+	return e.sentBandwidthKbps, e.receivedBandwidthKbps, e.ackedBandwidthKbps
+}
 
-	if *fragmentId >= *numFragments {
-		log.Errorf("[%s] fragment id %d outside of range of num fragments %d", name, *fragmentId, *numFragments)
-		return -1
+// readFragmentHeader reads the fragment header and checks it against the endpoint configuration
+func (e *Endpoint) readFragmentHeader(packetData []byte, header *FragmentHeader) (int, error) {
+	fragHeaderBytes, err := header.Unmarshal(packetData)
+	if err != nil {
+		return 0, err
 	}
 
-	*fragmentBytes = packetBytes - FragmentHeaderBytes
-
-	var packetSequence, packetAck uint16
-	var packetAckBits uint32
-
-	if *fragmentId == 0 {
-		packetHeaderBytes := readPacketHeader(name, packetData[FragmentHeaderBytes:], &packetSequence, &packetAck, &packetAckBits)
-
-		if packetHeaderBytes < 0 {
-			log.Errorf("[%s] bad packet header in fragment", name)
-			return -1
-		}
-
-		if packetSequence != *sequence {
-			log.Errorf("[%s] bad packet sequence in fragment. expected %d, got %d", name, *sequence, packetSequence)
-			return -1
-		}
-
-		*fragmentBytes = packetBytes - packetHeaderBytes - FragmentHeaderBytes
+	if header.NumFragments > e.config.MaxFragments {
+		return 0, fmt.Errorf("%w: num fragments %d outside of range of max fragments %d", ErrInvalidFragment, header.NumFragments, e.config.MaxFragments)
 	}
 
-	*ack = packetAck
-	*ackBits = packetAckBits
-
-	if *fragmentBytes > fragmentSize {
-		log.Errorf("[%s] fragment bytes %d > fragment size %d", name, *fragmentBytes, fragmentSize)
-		return -1
+	fragmentBytes := len(packetData) - fragHeaderBytes
+	if fragmentBytes > e.config.FragmentSize {
+		return 0, fmt.Errorf("%w: fragment bytes %d > fragment size %d", ErrInvalidFragment, fragmentBytes, e.config.FragmentSize)
 	}
 
-	if *fragmentId != *numFragments-1 && *fragmentBytes != fragmentSize {
-		log.Errorf("[%s] fragment %d is %d bytes, which is not the expected fragment size %d", name, *fragmentId, *fragmentBytes, fragmentSize)
-		return -1
+	if header.FragmentId != header.NumFragments-1 && fragmentBytes != e.config.FragmentSize {
+		return 0, fmt.Errorf("%w: fragment %d is %d bytes, which is not the expected fragment size %d", ErrInvalidFragment, header.FragmentId, fragmentBytes, e.config.FragmentSize)
 	}
 
-	return p.pos
-}
-
-func lessThan(s1, s2 uint16) bool {
-	return greaterThan(s2, s1)
-}
-
-func greaterThan(s1, s2 uint16) bool {
-	return ((s1 > s2) && (s1-s2 <= 32768)) || ((s1 < s2) && (s2-s1 > 32768))
+	return fragHeaderBytes, nil
 }
 
 const (
@@ -627,10 +793,26 @@ const (
 	counterNumFragmentsSent
 	counterNumFragmentsReceived
 	counterNumFragmentsInvalid
+	counterNumPacketsWrongProtocol
+	counterNumPacketsCorrupt
+	counterNumAcksSent
+	counterNumAcksReceived
+	counterNumAllocationsFailed
+	counterNumPacketsLate
+	counterNumPacketsReordered
+	counterNumPacketsSkipped
+	counterNumPacketsDuplicate
+	counterNumPacketsRecovered
+	counterNumRedundantPayloadsDelivered
+	counterNumPacketsCompressed
+	counterNumBytesBeforeCompression
+	counterNumBytesAfterCompression
+	counterNumPacketsExpired
+	counterNumPacketsLost
 	counterMax
 )
 
 const (
-	MaxPacketHeaderBytes = 9
+	MaxPacketHeaderBytes = 14
 	FragmentHeaderBytes  = 5
 )
@@ -8,75 +8,104 @@ import (
 func TestPacketHeader(t *testing.T) {
 	logging.SetLevel(logging.ERROR, "rely")
 
-	var writeSequence, writeAck, readSequence, readAck uint16
-	var writeAckBits, readAckBits uint32
+	var writeHeader, readHeader PacketHeader
 
-	packetData := newBuffer(MaxPacketHeaderBytes)
+	packetData := make([]byte, MaxPacketHeaderBytes)
 
 	// worst case, sequence and ack are far apart, no packets acked
 
-	writeSequence = 10000
-	writeAck = 100
-	writeAckBits = 0
+	writeHeader = PacketHeader{Sequence: 10000, Ack: 100, AckBits: 0}
 
-	bytesWritten := writePacketHeader(packetData, writeSequence, writeAck, writeAckBits)
-	if bytesWritten != MaxPacketHeaderBytes {
-		t.Error("Should have written", MaxPacketHeaderBytes, "but got", bytesWritten)
+	bytesWritten, _ := writeHeader.Marshal(packetData)
+	if bytesWritten != 1+2+2+4 {
+		t.Error("Should have written", 1+2+2+4, "but got", bytesWritten)
 	}
 
-	bytesRead := readPacketHeader("test_packet_header", packetData.buf, &readSequence, &readAck, &readAckBits)
-	if bytesRead != bytesWritten || readSequence != writeSequence || readAck != writeAck || readAckBits != writeAckBits {
-		t.Error("read != write", bytesRead, bytesWritten, readSequence, writeSequence, readAck, writeAck, readAckBits, writeAckBits)
+	bytesRead, err := readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
 	}
 
 	// rare case. sequence and ack are far apart, significant # of acks are missing
 
-	writeSequence = 10000
-	writeAck = 100
-	writeAckBits = 0xFEFEFFFE
+	writeHeader = PacketHeader{Sequence: 10000, Ack: 100, AckBits: 0xFEFEFFFE}
 
-	bytesWritten = writePacketHeader(packetData.reset(), writeSequence, writeAck, writeAckBits)
+	bytesWritten, _ = writeHeader.Marshal(packetData)
 	if bytesWritten != 1+2+2+3 {
 		t.Error(bytesWritten, "!=", 1+2+2+3)
 	}
 
-	bytesRead = readPacketHeader("test_packet_header", packetData.buf, &readSequence, &readAck, &readAckBits)
-	if bytesRead != bytesWritten || readSequence != writeSequence || readAck != writeAck || readAckBits != writeAckBits {
-		t.Error("read != write", bytesRead, bytesWritten, readSequence, writeSequence, readAck, writeAck, readAckBits, writeAckBits)
+	bytesRead, err = readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
 	}
 
 	// common case under packet loss. sequence and ack are close together, some acks are missing
 
-	writeSequence = 200
-	writeAck = 100
-	writeAckBits = 0xFFFEFFFF
+	writeHeader = PacketHeader{Sequence: 200, Ack: 100, AckBits: 0xFFFEFFFF}
 
-	bytesWritten = writePacketHeader(packetData.reset(), writeSequence, writeAck, writeAckBits)
+	bytesWritten, _ = writeHeader.Marshal(packetData)
 
 	if bytesWritten != 1+2+1+1 {
 		t.Error(bytesWritten, "!=", 1+2+1+1)
 	}
 
-	bytesRead = readPacketHeader("test_packet_header", packetData.buf, &readSequence, &readAck, &readAckBits)
-	if bytesRead != bytesWritten || readSequence != writeSequence || readAck != writeAck || readAckBits != writeAckBits {
-		t.Error("read != write", bytesRead, bytesWritten, readSequence, writeSequence, readAck, writeAck, readAckBits, writeAckBits)
+	bytesRead, err = readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
 	}
 
 	// ideal case. no packet loss.
 
-	writeSequence = 200
-	writeAck = 100
-	writeAckBits = 0xFFFFFFFF
+	writeHeader = PacketHeader{Sequence: 200, Ack: 100, AckBits: 0xFFFFFFFF}
 
-	bytesWritten = writePacketHeader(packetData.reset(), writeSequence, writeAck, writeAckBits)
+	bytesWritten, _ = writeHeader.Marshal(packetData)
 
 	if bytesWritten != 1+2+1 {
 		t.Error(bytesWritten, "!=", 1+2+1)
 	}
 
-	bytesRead = readPacketHeader("test_packet_header", packetData.buf, &readSequence, &readAck, &readAckBits)
-	if bytesRead != bytesWritten || readSequence != writeSequence || readAck != writeAck || readAckBits != writeAckBits {
-		t.Error("read != write", bytesRead, bytesWritten, readSequence, writeSequence, readAck, writeAck, readAckBits, writeAckBits)
+	bytesRead, err = readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
+	}
+
+	// worst case with a 64 packet ack window, only the most recent packet acked
+
+	writeHeader = PacketHeader{Sequence: 10000, Ack: 100, AckBits: 0x1}
+
+	bytesWritten, _ = writeHeader.Marshal(packetData)
+
+	if bytesWritten != 1+2+2+4 {
+		t.Error(bytesWritten, "!=", 1+2+2+4)
+	}
+
+	writeHeader = PacketHeader{Sequence: 10000, Ack: 100, AckBits: 0x100000000}
+
+	bytesWritten, _ = writeHeader.Marshal(packetData)
+
+	if bytesWritten != MaxPacketHeaderBytes {
+		t.Error("Should have written", MaxPacketHeaderBytes, "but got", bytesWritten)
+	}
+
+	bytesRead, err = readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
+	}
+
+	// common case with a 64 packet ack window, some acks are missing
+
+	writeHeader = PacketHeader{Sequence: 200, Ack: 100, AckBits: 0xFFEFFFFFFFFFFFFF}
+
+	bytesWritten, _ = writeHeader.Marshal(packetData)
+
+	if bytesWritten != 1+2+1+1+1 {
+		t.Error(bytesWritten, "!=", 1+2+1+1+1)
+	}
+
+	bytesRead, err = readHeader.Unmarshal(packetData)
+	if err != nil || bytesRead != bytesWritten || readHeader != writeHeader {
+		t.Error("read != write", err, bytesRead, bytesWritten, readHeader, writeHeader)
 	}
 }
 
@@ -327,3 +356,395 @@ func TestPackets(t *testing.T) {
 		time += deltaTime
 	}
 }
+
+func newTestEndpoints(context *testContext, time float64, configure func(config *Config)) {
+	senderConfig := NewDefaultConfig()
+	senderConfig.Name = "sender"
+	receiverConfig := NewDefaultConfig()
+	receiverConfig.Name = "receiver"
+
+	senderConfig.Context = context
+	senderConfig.Index = 0
+	senderConfig.TransmitPacketFunction = testTransmitPacketFunction
+	senderConfig.ProcessPacketFunction = testProcessPacketFunction
+
+	receiverConfig.Context = context
+	receiverConfig.Index = 1
+	receiverConfig.TransmitPacketFunction = testTransmitPacketFunction
+	receiverConfig.ProcessPacketFunction = testProcessPacketFunction
+
+	if configure != nil {
+		configure(senderConfig)
+		configure(receiverConfig)
+	}
+
+	context.sender = NewEndpoint(senderConfig, time)
+	context.receiver = NewEndpoint(receiverConfig, time)
+}
+
+func TestProtocolId(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.ProtocolId = 0x12345678
+		config.ProtocolVersion = 2
+	})
+
+	context.sender.SendPacket(make([]byte, 100))
+	context.sender.SendPacket(make([]byte, 3000))
+	if context.receiver.PacketsReceived() != 2 || context.receiver.PacketsWrongProtocol() != 0 {
+		t.Error("Packets with matching protocol not received", context.receiver.PacketsReceived(), context.receiver.PacketsWrongProtocol())
+	}
+
+	var captured []byte
+	context.sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		captured = append(captured[:0], packetData...)
+	}
+	context.sender.SendPacket(make([]byte, 100))
+	if id, version, ok := DatagramProtocol(captured); !ok || id != 0x12345678 || version != 2 {
+		t.Error("Wrong protocol in datagram", id, version, ok)
+	}
+
+	// an older release of the same application
+	context.receiver.config.ProtocolVersion = 1
+	context.receiver.ReceivePacket(captured)
+	if context.receiver.PacketsReceived() != 2 || context.receiver.PacketsWrongProtocol() != 1 {
+		t.Error("Packet with different protocol version not rejected", context.receiver.PacketsReceived(), context.receiver.PacketsWrongProtocol())
+	}
+
+	// another application entirely, whose first byte looks like a rely packet
+	context.receiver.ReceivePacket([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9})
+	if context.receiver.PacketsReceived() != 2 || context.receiver.PacketsWrongProtocol() != 2 {
+		t.Error("Foreign datagram not rejected", context.receiver.PacketsReceived(), context.receiver.PacketsWrongProtocol())
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	for _, protocolId := range []uint32{0, 0x12345678} {
+		var context testContext
+		newTestEndpoints(&context, 100, func(config *Config) {
+			config.Checksum = true
+			config.ProtocolId = protocolId
+		})
+
+		var captured [][]byte
+		context.sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+			captured = append(captured, append([]byte(nil), packetData...))
+		}
+		context.sender.SendPacket(make([]byte, 100))
+		context.sender.SendPacket(make([]byte, 3000))
+
+		for _, packetData := range captured {
+			for i := range packetData {
+				packetData[i] ^= 0x10
+				context.receiver.ReceivePacket(packetData)
+				packetData[i] ^= 0x10
+			}
+		}
+		// every flipped byte of every datagram is detected, and flipped protocol bytes are a different protocol
+		expected, wrongProtocol := 0, 0
+		for _, packetData := range captured {
+			expected += len(packetData)
+			if protocolId != 0 {
+				expected -= ProtocolTrailerBytes
+				wrongProtocol += ProtocolTrailerBytes
+			}
+		}
+		if context.receiver.PacketsReceived() != 0 || context.receiver.PacketsWrongProtocol() != uint64(wrongProtocol) {
+			t.Error("Corrupt packets were received", context.receiver.PacketsReceived(), context.receiver.PacketsWrongProtocol())
+		}
+		if context.receiver.PacketsCorrupt() != uint64(expected) {
+			t.Error("Expected", expected, "corrupt packets, got", context.receiver.PacketsCorrupt())
+		}
+
+		// a datagram of another protocol version is not counted as corrupt
+		if protocolId != 0 {
+			otherConfig := *context.receiver.config
+			otherConfig.ProtocolVersion = 1
+			other := NewEndpoint(&otherConfig, 100)
+			other.ReceivePacket(captured[0])
+			if other.PacketsCorrupt() != 0 || other.PacketsWrongProtocol() != 1 {
+				t.Error("Expected a different protocol, got", other.PacketsCorrupt(), other.PacketsWrongProtocol())
+			}
+		}
+
+		for _, packetData := range captured {
+			context.receiver.ReceivePacket(packetData)
+		}
+		if context.receiver.PacketsReceived() != 2 {
+			t.Error("Intact packets were not received", context.receiver.PacketsReceived())
+		}
+	}
+}
+
+func TestExtendedSequences(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	for _, extended := range []bool{false, true} {
+		var context testContext
+		newTestEndpoints(&context, 100, func(config *Config) {
+			config.ExtendedSequences = extended
+		})
+
+		var processed []uint64
+		context.receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, sequence uint16, _ []byte) bool {
+			processed = append(processed, context.receiver.ExtendSequence(sequence))
+			return true
+		}
+
+		// run through a wrap of the 16 bit sequence
+		for i := 0; i < 70000; i++ {
+			context.sender.SendPacket([]byte{1, 2, 3})
+		}
+		if extended {
+			for i, sequence := range processed {
+				if sequence != uint64(i) {
+					t.Fatal("Packet", i, "extended to", sequence)
+				}
+			}
+		}
+		if context.sender.NextPacketSequenceExtended() != 70000 || context.sender.ExtendAck(69999-65536) != 69999 {
+			t.Error("Wrong sent sequence", context.sender.NextPacketSequenceExtended(), context.sender.ExtendAck(69999-65536))
+		}
+
+		// a long stall, during which the sender moves 40000 packets on
+		context.drop = 1
+		for i := 0; i < 40000; i++ {
+			context.sender.SendPacket([]byte{1, 2, 3})
+		}
+		context.drop = 0
+		context.receiver.Update(100 + resyncStallTime)
+
+		processed = processed[:0]
+		for i := 0; i < 2*resyncStalePackets; i++ {
+			context.sender.SendPacket([]byte{1, 2, 3})
+		}
+		if !extended {
+			if len(processed) != 0 {
+				t.Error("Packets after the stall were expected to look stale")
+			}
+			continue
+		}
+		if len(processed) != resyncStalePackets+1 {
+			t.Fatal("Expected to resynchronize after", resyncStalePackets, "stale packets, processed", len(processed))
+		}
+		for i, sequence := range processed {
+			if expected := uint64(110000 + resyncStalePackets - 1 + i); sequence != expected {
+				t.Error("Packet after the stall extended to", sequence, "expected", expected)
+			}
+		}
+	}
+}
+
+func TestExtendedSequences_Replay(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.ExtendedSequences = true
+	})
+	sender, receiver := context.sender, context.receiver
+
+	var sent [][]byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+		receiver.ReceivePacket(packetData)
+	}
+	for i := 0; i < 300; i++ {
+		sender.SendPacket([]byte{1, 2, 3})
+	}
+	for i := 0; i < 300; i++ {
+		sender.SendPacket(make([]byte, 3000))
+	}
+	intact := func() bool {
+		return receiver.ExtendSequence(599) == 599 && receiver.receivedPackets.Exists(599)
+	}
+
+	// a burst of old packets and fragments without a stall
+	for i := 0; i < 4*resyncStalePackets; i++ {
+		receiver.ReceivePacket(sent[i])
+		receiver.ReceivePacket(sent[300+3*i])
+	}
+	if !intact() {
+		t.Fatal("Replayed packets resynchronized the endpoint", receiver.ExtendSequence(599))
+	}
+
+	// the same old packet over and over after a stall
+	receiver.Update(100 + resyncStallTime)
+	for i := 0; i < 4*resyncStalePackets; i++ {
+		receiver.ReceivePacket(sent[0])
+	}
+	if !intact() {
+		t.Error("Replayed packet resynchronized the endpoint", receiver.ExtendSequence(599))
+	}
+}
+
+func TestAckWindow(t *testing.T) {
+	logging.SetLevel(logging.ERROR, "rely")
+
+	for _, ackWindow := range []int{32, 64} {
+		var context testContext
+		newTestEndpoints(&context, 100, func(config *Config) {
+			config.AckWindow = ackWindow
+		})
+
+		// the receiver has nothing to say for a while, then sends a single packet
+		for i := 0; i < 50; i++ {
+			context.sender.SendPacket([]byte{1, 2, 3})
+		}
+		context.receiver.SendPacket([]byte{1, 2, 3})
+
+		acks := context.sender.GetAcks()
+		if len(acks) != ackWindow && !(ackWindow == 64 && len(acks) == 50) {
+			t.Error("Ack window", ackWindow, "acked", len(acks), "packets")
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	logging.SetLevel(logging.ERROR, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.KeepaliveInterval = 0.1
+	})
+
+	var processed int
+	context.sender.config.ProcessPacketFunction = func(_ interface{}, _ int, _ uint16, _ []byte) bool {
+		processed++
+		return true
+	}
+
+	// only the sender has anything to say, the receiver acks through keepalives
+	time := 100.0
+	for i := 0; i < 100; i++ {
+		context.sender.SendPacket([]byte{1, 2, 3})
+		time += 0.06
+		context.sender.Update(time)
+		context.receiver.Update(time)
+	}
+
+	if processed != 0 || context.sender.PacketsReceived() != 0 {
+		t.Error("Ack-only packets were processed as payloads", processed, context.sender.PacketsReceived())
+	}
+	if context.receiver.AcksSent() != 50 || context.sender.AcksReceived() != 50 {
+		t.Error("Expected a keepalive every other update", context.receiver.AcksSent(), context.sender.AcksReceived())
+	}
+	if context.sender.PacketsAcked() != 100 || context.sender.Rtt() == 0 {
+		t.Error("Keepalives did not ack", context.sender.PacketsAcked(), context.sender.Rtt())
+	}
+	if context.sender.NextPacketSequence() != 100 || context.receiver.NextPacketSequence() != 0 {
+		t.Error("Ack-only packets used up a sequence", context.sender.NextPacketSequence(), context.receiver.NextPacketSequence())
+	}
+
+	// the sender is busy, so it never needs a keepalive
+	if context.sender.AcksSent() != 0 {
+		t.Error("Sender sent keepalives", context.sender.AcksSent())
+	}
+
+	// compat mode has no ack-only packets, so an empty packet goes out instead
+	context.receiver.config.ReliableIOCompatible = true
+	context.receiver.SendAck()
+	if context.receiver.AcksSent() != 50 || context.receiver.NextPacketSequence() != 1 {
+		t.Error("Compatible ack was not an empty packet", context.receiver.AcksSent(), context.receiver.NextPacketSequence())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, func(config *Config) {
+		config.Timeout = 1
+	})
+
+	var timeouts []int
+	context.sender.config.OnTimeout = func(_ interface{}, index int) {
+		timeouts = append(timeouts, index)
+	}
+
+	context.receiver.SendPacket([]byte{1, 2, 3})
+	context.sender.Update(100.9)
+	if context.sender.TimedOut() || len(timeouts) != 0 || context.sender.TimeSinceLastReceive() < 0.89 {
+		t.Error("Timed out too early", context.sender.TimeSinceLastReceive())
+	}
+
+	// an ack-only packet also shows the peer is alive
+	context.receiver.Update(100.9)
+	context.receiver.SendAck()
+	context.sender.Update(101.8)
+	if context.sender.TimedOut() || context.sender.TimeSinceLastReceive() > 0.91 {
+		t.Error("Ack-only packet did not count as received", context.sender.TimeSinceLastReceive())
+	}
+
+	// garbage does not
+	context.sender.ReceivePacket([]byte{1})
+	context.sender.Update(102)
+	context.sender.Update(102.5)
+	if !context.sender.TimedOut() || len(timeouts) != 1 || timeouts[0] != 0 {
+		t.Error("Did not time out", context.sender.TimeSinceLastReceive(), timeouts)
+	}
+
+	context.receiver.Update(102.5)
+	context.receiver.SendPacket([]byte{1, 2, 3})
+	context.sender.Update(104)
+	if !context.sender.TimedOut() || len(timeouts) != 1 {
+		t.Error("Timeout was not sticky", timeouts)
+	}
+
+	context.sender.Reset()
+	if context.sender.TimedOut() || context.sender.TimeSinceLastReceive() != 0 {
+		t.Error("Reset did not clear the timeout")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	var context testContext
+	newTestEndpoints(&context, 100, nil)
+	sender, receiver := context.sender, context.receiver
+
+	var sent [][]byte
+	sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+		sent = append(sent, append([]byte(nil), packetData...))
+	}
+	processed := map[uint16]int{}
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, sequence uint16, _ []byte) bool {
+		processed[sequence]++
+		return true
+	}
+
+	sender.SendPacket([]byte{1, 2, 3})
+	sender.SendPacket(make([]byte, 3000))
+	for i := 0; i < 2; i++ {
+		for _, packetData := range sent {
+			receiver.ReceivePacket(packetData)
+		}
+	}
+	if processed[0] != 1 || processed[1] != 1 {
+		t.Error("Expected each packet to be processed once, got", processed)
+	}
+	if receiver.PacketsDuplicate() != 4 {
+		t.Error("Expected the packet and 3 fragments to be duplicates, got", receiver.PacketsDuplicate())
+	}
+	if receiver.fragmentReassembly.Exists(1) {
+		t.Error("Duplicate fragment started a reassembly")
+	}
+
+	// a packet that was not accepted is not a duplicate
+	receiver.config.ProcessPacketFunction = func(_ interface{}, _ int, sequence uint16, _ []byte) bool {
+		processed[sequence]++
+		return processed[sequence] > 1
+	}
+	sender.SendPacket([]byte{4})
+	receiver.ReceivePacket(sent[len(sent)-1])
+	receiver.ReceivePacket(sent[len(sent)-1])
+	receiver.ReceivePacket(sent[len(sent)-1])
+	if processed[2] != 2 || receiver.PacketsDuplicate() != 5 {
+		t.Error("Expected a rejected packet to be processed again, got", processed, receiver.PacketsDuplicate())
+	}
+}
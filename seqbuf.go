@@ -1,45 +1,46 @@
 package rely
 
-import (
-	"math"
-)
-
-// sequenceBuffer is a generic store for sent and received packets, as well as fragments of packets.
-// The entry data is the actual custom packet data that the user is trying to send
-type sequenceBuffer struct {
-	Sequence uint16
+// SequenceBuffer is a store of data keyed by 16 bit sequence numbers, holding the most recent NumEntries
+// sequences. Endpoints use it for sent and received packets as well as fragments of packets, and it works
+// just as well for application data such as snapshot history or inputs.
+type SequenceBuffer[T any] struct {
+	// Sequence is one past the most recent sequence inserted
+	Sequence   uint16
 	NumEntries int
+	// EntrySequence holds the sequence of each entry, or an unused value if the entry is empty
 	EntrySequence []uint32
+	// EntryData holds the data of each entry
+	EntryData []T
 }
 
 const available = 0xFFFFFFFF
 
-// newSequenceBuffer creates a sequence buffer with specified entries and stride (size of each packet's data)
-func newSequenceBuffer(numEntries int) *sequenceBuffer {
-	sb :=  &sequenceBuffer{
-		NumEntries: numEntries,
+// NewSequenceBuffer creates a sequence buffer with the specified number of entries
+func NewSequenceBuffer[T any](numEntries int) *SequenceBuffer[T] {
+	sb := &SequenceBuffer[T]{
+		NumEntries:    numEntries,
 		EntrySequence: make([]uint32, numEntries),
+		EntryData:     make([]T, numEntries),
 	}
 	sb.Reset()
 	return sb
 }
 
 // Reset starts the sequence buffer from scratch
-func (sb *sequenceBuffer) Reset() {
+func (sb *SequenceBuffer[T]) Reset() {
 	sb.Sequence = 0
 	for i := 0; i < sb.NumEntries; i++ {
-		sb.EntrySequence[i] = math.MaxUint32
+		sb.EntrySequence[i] = available
 	}
 }
 
 // RemoveEntries removes old entries from start sequence to finish sequence (inclusive)
-func (sb *sequenceBuffer) RemoveEntries(start, finish int) {
+func (sb *SequenceBuffer[T]) RemoveEntries(start, finish int) {
 	if finish < start {
 		finish += 65536
 	}
-	if finish - start < sb.NumEntries {
+	if finish-start < sb.NumEntries {
 		for sequence := start; sequence <= finish; sequence++ {
-			// cleanup?
 			sb.EntrySequence[sequence%sb.NumEntries] = available
 		}
 	} else {
@@ -50,173 +51,117 @@ func (sb *sequenceBuffer) RemoveEntries(start, finish int) {
 }
 
 // TestInsert checks to see if the sequence can be inserted
-func (sb *sequenceBuffer) TestInsert(sequence uint16) bool {
-	if lessThan(sequence, sb.Sequence - uint16(sb.NumEntries)) {
-		return false
-	}
-	return true
-}
-
-func (sb *sequenceBuffer) Remove(sequence uint16) {
-	sb.EntrySequence[int(sequence)%sb.NumEntries] = available
-}
-
-func (sb *sequenceBuffer) Available(sequence uint16) bool {
-	return sb.EntrySequence[int(sequence)] == available
-}
-
-func (sb *sequenceBuffer) Exists(sequence uint16) bool {
-	return sb.EntrySequence[int(sequence)%sb.NumEntries] == uint32(sequence)
-}
-
-func (sb *sequenceBuffer) GenerateAckBits(ack *uint16, ackBits *uint32) {
-	*ack = sb.Sequence-1
-	*ackBits = 0
-	var mask uint32 = 1
-	for i:=0; i<32; i++ {
-		sequence := *ack - uint16(i)
-		if sb.Exists(sequence) {
-			*ackBits |= mask
-		}
-		mask <<= 1
-	}
-}
-
-type sentPacketSequenceBuffer struct {
-	*sequenceBuffer
-	EntryData []sentPacketData
-}
-
-func newSentPacketSequenceBuffer(numEntries int) *sentPacketSequenceBuffer {
-	return &sentPacketSequenceBuffer{
-		sequenceBuffer: newSequenceBuffer(numEntries),
-		EntryData:      make([]sentPacketData, numEntries),
-	}
+func (sb *SequenceBuffer[T]) TestInsert(sequence uint16) bool {
+	return !SequenceLessThan(sequence, sb.Sequence-uint16(sb.NumEntries))
 }
 
-// Insert marks the sequence as used and returns an address to the buffer, or nil if insertion is invalid
-func (sb *sentPacketSequenceBuffer) Insert(sequence uint16) *sentPacketData {
-	if lessThan(sequence, sb.Sequence-uint16(sb.NumEntries)) {
+// Insert marks the sequence as used and returns its zeroed entry data, or nil if the sequence is too old
+func (sb *SequenceBuffer[T]) Insert(sequence uint16) *T {
+	if SequenceLessThan(sequence, sb.Sequence-uint16(sb.NumEntries)) {
 		// sequence is too low
 		return nil
 	}
-	if greaterThan(sequence + 1, sb.Sequence) {
+	if SequenceGreaterThan(sequence+1, sb.Sequence) {
 		// move the sequence forward, drop old entries
 		sb.RemoveEntries(int(sb.Sequence), int(sequence))
 		sb.Sequence = sequence + 1
 	}
 	index := int(sequence) % sb.NumEntries
 	sb.EntrySequence[index] = uint32(sequence)
+	var zero T
+	sb.EntryData[index] = zero
 	return &sb.EntryData[index]
 }
 
-// Find returns the entry data for the sequence, or nil if there is none
-func (sb *sentPacketSequenceBuffer) Find(sequence uint16) *sentPacketData {
-	index := int(sequence) % sb.NumEntries
-	if sb.EntrySequence[index] == uint32(sequence) {
-		return &sb.EntryData[index]
-	} else {
-		return nil
-	}
-}
-
-func (sb *sentPacketSequenceBuffer) AtIndex(index int) *sentPacketData {
-	if sb.EntrySequence[index] != available {
-		return &sb.EntryData[index]
-	} else {
-		return nil
-	}
+// Remove empties the entry of the sequence
+func (sb *SequenceBuffer[T]) Remove(sequence uint16) {
+	sb.EntrySequence[int(sequence)%sb.NumEntries] = available
 }
 
-type receivedPacketSequenceBuffer struct {
-	*sequenceBuffer
-	EntryData []receivedPacketData
+// Available returns true if the entry the sequence would go in is empty
+func (sb *SequenceBuffer[T]) Available(sequence uint16) bool {
+	return sb.EntrySequence[int(sequence)%sb.NumEntries] == available
 }
 
-func newReceivedPacketSequenceBuffer(numEntries int) *receivedPacketSequenceBuffer {
-	return &receivedPacketSequenceBuffer{
-		sequenceBuffer: newSequenceBuffer(numEntries),
-		EntryData:      make([]receivedPacketData, numEntries),
-	}
-}
-
-// Insert marks the sequence as used and returns an address to the buffer, or nil if insertion is invalid
-func (sb *receivedPacketSequenceBuffer) Insert(sequence uint16) *receivedPacketData {
-	if lessThan(sequence, sb.Sequence-uint16(sb.NumEntries)) {
-		// sequence is too low
-		return nil
-	}
-	if greaterThan(sequence + 1, sb.Sequence) {
-		// move the sequence forward, drop old entries
-		sb.RemoveEntries(int(sb.Sequence), int(sequence))
-		sb.Sequence = sequence + 1
-	}
-	index := int(sequence) % sb.NumEntries
-	sb.EntrySequence[index] = uint32(sequence)
-	return &sb.EntryData[index]
+// Exists returns true if the sequence is in the buffer
+func (sb *SequenceBuffer[T]) Exists(sequence uint16) bool {
+	return sb.EntrySequence[int(sequence)%sb.NumEntries] == uint32(sequence)
 }
 
 // Find returns the entry data for the sequence, or nil if there is none
-func (sb *receivedPacketSequenceBuffer) Find(sequence uint16) *receivedPacketData {
+func (sb *SequenceBuffer[T]) Find(sequence uint16) *T {
 	index := int(sequence) % sb.NumEntries
 	if sb.EntrySequence[index] == uint32(sequence) {
 		return &sb.EntryData[index]
-	} else {
-		return nil
 	}
+	return nil
 }
 
-func (sb *receivedPacketSequenceBuffer) AtIndex(index int) *receivedPacketData {
+// AtIndex returns the entry data at an index of the buffer, or nil if the entry is empty
+func (sb *SequenceBuffer[T]) AtIndex(index int) *T {
 	if sb.EntrySequence[index] != available {
 		return &sb.EntryData[index]
-	} else {
-		return nil
 	}
+	return nil
 }
 
-type fragmentSequenceBuffer struct {
-	*sequenceBuffer
-	EntryData []fragmentReassemblyData
+// Range calls f for every entry, from the oldest sequence to the most recent, until f returns false
+func (sb *SequenceBuffer[T]) Range(f func(sequence uint16, data *T) bool) {
+	for i := sb.NumEntries; i > 0; i-- {
+		sequence := sb.Sequence - uint16(i)
+		if data := sb.Find(sequence); data != nil && !f(sequence, data) {
+			return
+		}
+	}
 }
 
-func newFragmentSequenceBuffer(numEntries int) *fragmentSequenceBuffer {
-	return &fragmentSequenceBuffer{
-		sequenceBuffer: newSequenceBuffer(numEntries),
-		EntryData:      make([]fragmentReassemblyData, numEntries),
-	}
+// GenerateAckBits sets ack to the most recent sequence, and bit n of ackBits if ack-n is in the buffer
+func (sb *SequenceBuffer[T]) GenerateAckBits(ack *uint16, ackBits *uint32) {
+	var wideAckBits uint64
+	sb.GenerateWideAckBits(ack, &wideAckBits, 32)
+	*ackBits = uint32(wideAckBits)
 }
 
-// Insert marks the sequence as used and returns an address to the buffer, or nil if insertion is invalid
-func (sb *fragmentSequenceBuffer) Insert(sequence uint16) *fragmentReassemblyData {
-	if lessThan(sequence, sb.Sequence-uint16(sb.NumEntries)) {
-		// sequence is too low
-		return nil
-	}
-	if greaterThan(sequence + 1, sb.Sequence) {
-		// move the sequence forward, drop old entries
-		sb.RemoveEntries(int(sb.Sequence), int(sequence))
-		sb.Sequence = sequence + 1
+// GenerateWideAckBits generates ack bits for the most recent numBits sequences, up to 64
+func (sb *SequenceBuffer[T]) GenerateWideAckBits(ack *uint16, ackBits *uint64, numBits int) {
+	*ack = sb.Sequence - 1
+	*ackBits = 0
+	var mask uint64 = 1
+	for i := 0; i < numBits; i++ {
+		sequence := *ack - uint16(i)
+		if sb.Exists(sequence) {
+			*ackBits |= mask
+		}
+		mask <<= 1
 	}
-	index := int(sequence) % sb.NumEntries
-	sb.EntrySequence[index] = uint32(sequence)
-	return &sb.EntryData[index]
 }
 
-// Find returns the entry data for the sequence, or nil if there is none
-func (sb *fragmentSequenceBuffer) Find(sequence uint16) *fragmentReassemblyData {
-	index := int(sequence) % sb.NumEntries
-	if sb.EntrySequence[index] == uint32(sequence) {
-		return &sb.EntryData[index]
-	} else {
-		return nil
+// Resize returns a buffer of numEntries holding the entries that are still within its window
+func (sb *SequenceBuffer[T]) Resize(numEntries int) *SequenceBuffer[T] {
+	resized := NewSequenceBuffer[T](numEntries)
+	resized.Sequence = sb.Sequence
+	for i := 0; i < sb.NumEntries; i++ {
+		if sb.inWindow(i, numEntries) {
+			index := int(sb.EntrySequence[i]) % numEntries
+			resized.EntrySequence[index] = sb.EntrySequence[i]
+			resized.EntryData[index] = sb.EntryData[i]
+		}
 	}
+	return resized
 }
 
-func (sb *fragmentSequenceBuffer) AtIndex(index int) *fragmentReassemblyData {
-	if sb.EntrySequence[index] != available {
-		return &sb.EntryData[index]
-	} else {
-		return nil
-	}
+// inWindow returns true if the entry at index holds a sequence that a buffer of numEntries would still hold
+func (sb *SequenceBuffer[T]) inWindow(index, numEntries int) bool {
+	sequence := sb.EntrySequence[index]
+	return sequence != available && int(sb.Sequence-1-uint16(sequence)) < numEntries
 }
 
+// SequenceGreaterThan returns true if s1 is more recent than s2, allowing for the sequence wrapping around
+func SequenceGreaterThan(s1, s2 uint16) bool {
+	return ((s1 > s2) && (s1-s2 <= 32768)) || ((s1 < s2) && (s2-s1 > 32768))
+}
+
+// SequenceLessThan returns true if s1 is older than s2, allowing for the sequence wrapping around
+func SequenceLessThan(s1, s2 uint16) bool {
+	return SequenceGreaterThan(s2, s1)
+}
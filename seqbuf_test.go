@@ -7,7 +7,7 @@ import (
 const testSequenceBufferSize = 256
 
 func TestSequenceBuffer_Find(t *testing.T) {
-	sb := newFragmentSequenceBuffer(testSequenceBufferSize)
+	sb := NewSequenceBuffer[fragmentReassemblyData](testSequenceBufferSize)
 	if sb.Sequence != 0 || sb.NumEntries != testSequenceBufferSize {
 		t.Error("Failed to construct:", sb.Sequence, sb.NumEntries)
 	}
@@ -59,7 +59,7 @@ func TestSequenceBuffer_Find(t *testing.T) {
 }
 
 func TestSequenceBuffer_GenerateAckBits(t *testing.T) {
-	sb := newFragmentSequenceBuffer(testSequenceBufferSize)
+	sb := NewSequenceBuffer[fragmentReassemblyData](testSequenceBufferSize)
 
 	var ack uint16 = 0
 	var ackBits uint32 = 0xFFFFFFFF
@@ -90,3 +90,116 @@ func TestSequenceBuffer_GenerateAckBits(t *testing.T) {
 		t.Error("Failed to generate ack bits", ack, ackBits)
 	}
 }
+
+func TestSequenceBuffer_GenerateWideAckBits(t *testing.T) {
+	sb := NewSequenceBuffer[fragmentReassemblyData](testSequenceBufferSize)
+
+	var ack uint16
+	var ackBits uint64
+
+	for i := 0; i <= 100; i++ {
+		if i != 40 {
+			sb.Insert(uint16(i))
+		}
+	}
+
+	sb.GenerateWideAckBits(&ack, &ackBits, 64)
+	if ack != 100 || ackBits != 0xFFFFFFFFFFFFFFFF&^(1<<60) {
+		t.Errorf("Failed to generate wide ack bits %d %x", ack, ackBits)
+	}
+
+	sb.GenerateWideAckBits(&ack, &ackBits, 32)
+	if ack != 100 || ackBits != 0xFFFFFFFF {
+		t.Errorf("Failed to generate ack bits %d %x", ack, ackBits)
+	}
+}
+
+func TestSequenceBuffer_Range(t *testing.T) {
+	sb := NewSequenceBuffer[int](8)
+
+	for i := 0; i < 20; i++ {
+		if i != 15 {
+			*sb.Insert(uint16(i)) = i * 10
+		}
+	}
+
+	var sequences []uint16
+	sb.Range(func(sequence uint16, data *int) bool {
+		if *data != int(sequence)*10 {
+			t.Error("Wrong data", sequence, *data)
+		}
+		sequences = append(sequences, sequence)
+		return true
+	})
+	if len(sequences) != 7 || sequences[0] != 12 || sequences[3] != 16 || sequences[6] != 19 {
+		t.Error("Wrong sequences", sequences)
+	}
+
+	var n int
+	sb.Range(func(uint16, *int) bool {
+		n++
+		return n < 3
+	})
+	if n != 3 {
+		t.Error("Range did not stop", n)
+	}
+}
+
+func TestSequenceBuffer_InsertZeroes(t *testing.T) {
+	sb := NewSequenceBuffer[int](8)
+
+	*sb.Insert(3) = 42
+	if *sb.Insert(11) != 0 || sb.Exists(3) || !sb.Exists(11) || sb.Available(3) {
+		t.Error("Reused entry was not cleared")
+	}
+	sb.Remove(11)
+	if !sb.Available(3) || sb.Find(11) != nil {
+		t.Error("Entry was not removed")
+	}
+}
+
+func TestSequenceBuffer_Resize(t *testing.T) {
+	sb := NewSequenceBuffer[int](16)
+	for i := 65530; i < 65540; i++ {
+		*sb.Insert(uint16(i)) = i
+	}
+
+	smaller := sb.Resize(4)
+	if smaller.Sequence != sb.Sequence {
+		t.Error("Sequence not kept", smaller.Sequence)
+	}
+	for i := 65530; i < 65540; i++ {
+		data := smaller.Find(uint16(i))
+		if (data != nil) != (i >= 65536) || data != nil && *data != i {
+			t.Error("Sequence", i, "wrong after shrinking", data)
+		}
+	}
+
+	larger := smaller.Resize(64)
+	if larger.Find(3) == nil || larger.Find(0) == nil || larger.Find(65535) != nil {
+		t.Error("Entries wrong after growing")
+	}
+}
+
+func TestSequenceGreaterThan(t *testing.T) {
+	tests := []struct {
+		s1, s2  uint16
+		greater bool
+	}{
+		{1, 0, true},
+		{0, 1, false},
+		{0, 65535, true},
+		{65535, 0, false},
+		{32768, 0, true},
+		{32769, 0, false},
+		{5, 5, false},
+	}
+	for _, test := range tests {
+		if SequenceGreaterThan(test.s1, test.s2) != test.greater {
+			t.Error("SequenceGreaterThan", test.s1, test.s2, "should be", test.greater)
+		}
+		if test.s1 != test.s2 && SequenceLessThan(test.s2, test.s1) != test.greater {
+			t.Error("SequenceLessThan", test.s2, test.s1, "should be", test.greater)
+		}
+	}
+}
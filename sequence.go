@@ -0,0 +1,85 @@
+package rely
+
+// Sequences are 16 bits on the wire and wrap every 65536 packets. The endpoint also counts them
+// in 64 bits, reconstructing the full sequence of received packets the same way QUIC does: the
+// candidate closest to the next expected sequence wins.
+
+// resyncStalePackets is how many packets in a row must be older than the received packets buffer
+// before the endpoint assumes the peer has moved more than half the sequence space ahead. They only
+// count after nothing in the buffer was received for resyncStallTime seconds, and only while their
+// sequences move forward, so that replayed or reordered old packets do not resynchronize the endpoint.
+const (
+	resyncStalePackets = 8
+	resyncStallTime    = 1
+)
+
+// NextPacketSequenceExtended returns the full 64 bit sequence of the next packet that will be sent
+func (e *Endpoint) NextPacketSequenceExtended() uint64 {
+	return e.extendedSequence
+}
+
+// ExtendAck returns the full 64 bit sequence of an ack returned by GetAcks
+func (e *Endpoint) ExtendAck(ack uint16) uint64 {
+	return e.extendedSequence - uint64(e.sequence-ack)
+}
+
+// ExtendSequence returns the full 64 bit sequence of a recently received packet from its 16 bit
+// sequence. It is meant to be called from ProcessPacketFunction and requires Config.ExtendedSequences.
+func (e *Endpoint) ExtendSequence(sequence uint16) uint64 {
+	return extendSequence(e.receivedSequence, sequence)
+}
+
+func extendSequence(expected uint64, sequence uint16) uint64 {
+	const window = 1 << 16
+	const halfWindow = window / 2
+	candidate := (expected &^ (window - 1)) | uint64(sequence)
+	if candidate+halfWindow <= expected {
+		return candidate + window
+	}
+	if candidate > expected+halfWindow && candidate >= window {
+		return candidate - window
+	}
+	return candidate
+}
+
+// extendReceivedSequence reconstructs the full sequence of a received packet, returning false if it
+// is older than the received packets buffer. After a stall, a run of such packets resynchronizes the
+// receive buffers one wrap further on, since the peer may have moved far enough ahead to look old.
+func (e *Endpoint) extendReceivedSequence(sequence uint16) (uint64, bool) {
+	extendedSequence := e.ExtendSequence(sequence)
+	if extendedSequence+uint64(e.config.ReceivedPacketsBufferSize) >= e.receivedSequence {
+		e.staleRun = 0
+		e.lastSequenceTime = e.time
+		return extendedSequence, true
+	}
+
+	if e.time-e.lastSequenceTime < resyncStallTime {
+		// not a stall, just an old packet
+		e.staleRun = 0
+		return extendedSequence, false
+	}
+	if e.staleRun == 0 || !SequenceGreaterThan(sequence, e.staleSequence) || sequence-e.staleSequence > uint16(e.config.ReceivedPacketsBufferSize) {
+		// not following on from the run
+		e.staleRun = 0
+	}
+	e.staleRun++
+	e.staleSequence = sequence
+	if e.staleRun < resyncStalePackets {
+		return extendedSequence, false
+	}
+
+	extendedSequence += 1 << 16
+	log.Warningf("[%s] resynchronizing after a long stall. expected packet %d, got %d", e.config.Name, e.receivedSequence, extendedSequence)
+	e.staleRun = 0
+	e.lastSequenceTime = e.time
+	e.receivedSequence = extendedSequence + 1
+	e.receivedPackets.Reset()
+	e.receivedPackets.Sequence = sequence
+	e.receivedWindow.invalidate()
+	e.resetFragmentReassembly()
+	e.fragmentReassembly.Sequence = sequence
+	// held packets are from before the stall, deliver them before starting over
+	e.deliverHeldPackets(e.jitter.held.Sequence)
+	e.resetJitterBuffer()
+	return extendedSequence, true
+}
@@ -0,0 +1,267 @@
+package rely
+
+import (
+	"math"
+)
+
+// windowStats keeps the number, bytes and time range of the packets in a window of sequences, so that Update
+// does not have to scan the sequence buffers. The window slides forward as packets are inserted, counting the
+// packets that enter it and uncounting the ones that leave. Anything that changes a packet inside the window
+// out of order, like a late ack or a late packet, invalidates it to be rebuilt by a scan in the next Update.
+type windowStats struct {
+	start uint16
+	size  int
+	count int
+	bytes int
+	// earliest and latest are nil when only the count is needed
+	earliest *timeDeque
+	latest   *timeDeque
+	// sliding is false when the buffer size does not divide the sequence space, so buffer slots do not line
+	// up across the wrap and the window is rebuilt on every Update
+	sliding bool
+	invalid bool
+	// include returns the packet with the sequence if it exists and belongs in the window
+	include func(sequence uint16) (time float64, bytes uint32, ok bool)
+}
+
+func newWindowStats(size, bufferSize int, times bool, include func(uint16) (float64, uint32, bool)) windowStats {
+	w := windowStats{
+		size:    size,
+		sliding: bufferSize > 0 && 65536%bufferSize == 0,
+		invalid: true,
+		include: include,
+	}
+	if times {
+		w.earliest = newTimeDeque(size, false)
+		w.latest = newTimeDeque(size, true)
+	}
+	return w
+}
+
+// contains returns true if the sequence is in the window
+func (w *windowStats) contains(sequence uint16) bool {
+	return int(sequence-w.start) < w.size
+}
+
+// invalidate makes the next sync rebuild the window
+func (w *windowStats) invalidate() {
+	w.invalid = true
+}
+
+// slide moves the start of the window forward, before the buffer insert that moves its sequence forward
+func (w *windowStats) slide(start uint16) {
+	distance := int(start - w.start)
+	if w.invalid || !w.sliding || distance > w.size {
+		// the insert will remove packets from the window that have yet to enter it
+		w.start = start
+		w.invalid = true
+		return
+	}
+	for i := 0; i < distance; i++ {
+		w.remove(w.start)
+		w.add(w.start + uint16(w.size))
+		w.start++
+	}
+}
+
+// uncount removes a packet from the count without touching the time range, for when it stops
+// belonging in a window that only counts
+func (w *windowStats) uncount(sequence uint16) {
+	if w.contains(sequence) {
+		if w.earliest != nil {
+			w.invalid = true
+			return
+		}
+		w.count--
+	}
+}
+
+// sync rebuilds the window if it is invalid or does not start where the buffer says it should
+func (w *windowStats) sync(start uint16) {
+	if w.start != start || !w.sliding {
+		w.start = start
+		w.invalid = true
+	}
+	if !w.invalid {
+		return
+	}
+	w.count = 0
+	w.bytes = 0
+	if w.earliest != nil {
+		w.earliest.clear()
+		w.latest.clear()
+	}
+	for i := 0; i < w.size; i++ {
+		w.add(w.start + uint16(i))
+	}
+	w.invalid = false
+}
+
+// timeRange returns the earliest and latest times in the window, as the scan in Update found them
+func (w *windowStats) timeRange() (startTime, finishTime float64) {
+	startTime = math.MaxFloat64
+	if time, ok := w.earliest.front(); ok {
+		startTime = time
+	}
+	if time, ok := w.latest.front(); ok && time > 0 {
+		finishTime = time
+	}
+	return startTime, finishTime
+}
+
+func (w *windowStats) add(sequence uint16) {
+	time, bytes, ok := w.include(sequence)
+	if !ok {
+		return
+	}
+	w.count++
+	w.bytes += int(bytes)
+	if w.earliest != nil {
+		w.earliest.push(sequence, time)
+		w.latest.push(sequence, time)
+	}
+}
+
+func (w *windowStats) remove(sequence uint16) {
+	_, bytes, ok := w.include(sequence)
+	if !ok {
+		return
+	}
+	w.count--
+	w.bytes -= int(bytes)
+	if w.earliest != nil {
+		w.earliest.pop(sequence)
+		w.latest.pop(sequence)
+	}
+}
+
+// timeDeque holds the times of the packets in a window in sequence order, dropping the ones that can no
+// longer be the earliest (or latest) while they are in the window, so the front is always the earliest (or latest)
+type timeDeque struct {
+	sequences []uint16
+	times     []float64
+	head      int
+	length    int
+	latest    bool
+}
+
+func newTimeDeque(size int, latest bool) *timeDeque {
+	if size < 1 {
+		size = 1
+	}
+	return &timeDeque{
+		sequences: make([]uint16, size),
+		times:     make([]float64, size),
+		latest:    latest,
+	}
+}
+
+func (d *timeDeque) clear() {
+	d.head = 0
+	d.length = 0
+}
+
+// push adds the time of a packet newer than any in the deque
+func (d *timeDeque) push(sequence uint16, time float64) {
+	for d.length > 0 {
+		back := (d.head + d.length - 1) % len(d.times)
+		if d.latest && d.times[back] > time || !d.latest && d.times[back] < time {
+			break
+		}
+		d.length--
+	}
+	index := (d.head + d.length) % len(d.times)
+	d.sequences[index] = sequence
+	d.times[index] = time
+	d.length++
+}
+
+// pop removes the time of the oldest packet in the window, if it is still in the deque
+func (d *timeDeque) pop(sequence uint16) {
+	if d.length > 0 && d.sequences[d.head] == sequence {
+		d.head = (d.head + 1) % len(d.times)
+		d.length--
+	}
+}
+
+func (d *timeDeque) front() (float64, bool) {
+	if d.length == 0 {
+		return 0, false
+	}
+	return d.times[d.head], true
+}
+
+// initStats creates the windows for the buffers and config of the endpoint
+func (e *Endpoint) initStats() {
+	sentBufferSize := e.sentPackets.NumEntries
+	receivedBufferSize := e.receivedPackets.NumEntries
+
+	e.lossWindow = newWindowStats(e.config.SentPacketsBufferSize/2, sentBufferSize, false, func(sequence uint16) (float64, uint32, bool) {
+		sentPacketData := e.sentPackets.Find(sequence)
+		return 0, 0, sentPacketData != nil && sentPacketData.Acked == 0
+	})
+	e.sentWindow = newWindowStats(e.config.SentPacketsBufferSize/2, sentBufferSize, true, func(sequence uint16) (float64, uint32, bool) {
+		sentPacketData := e.sentPackets.Find(sequence)
+		if sentPacketData == nil {
+			return 0, 0, false
+		}
+		return sentPacketData.Time, sentPacketData.PacketBytes, true
+	})
+	e.receivedWindow = newWindowStats(e.config.ReceivedPacketsBufferSize/2, receivedBufferSize, true, func(sequence uint16) (float64, uint32, bool) {
+		receivedPacketData := e.receivedPackets.Find(sequence)
+		if receivedPacketData == nil {
+			return 0, 0, false
+		}
+		return receivedPacketData.Time, receivedPacketData.PacketBytes, true
+	})
+	// acked bandwidth has always sampled half of the received packets buffer size worth of sent packets
+	e.ackedWindow = newWindowStats(e.config.ReceivedPacketsBufferSize/2, sentBufferSize, true, func(sequence uint16) (float64, uint32, bool) {
+		sentPacketData := e.sentPackets.Find(sequence)
+		if sentPacketData == nil || sentPacketData.Acked == 0 {
+			return 0, 0, false
+		}
+		return sentPacketData.Time, sentPacketData.PacketBytes, true
+	})
+}
+
+// invalidateStats rebuilds all windows in the next Update, after the buffers were reset
+func (e *Endpoint) invalidateStats() {
+	e.lossWindow.invalidate()
+	e.sentWindow.invalidate()
+	e.receivedWindow.invalidate()
+	e.ackedWindow.invalidate()
+}
+
+// slideSentStats is called before inserting a sent packet
+func (e *Endpoint) slideSentStats(sequence uint16) {
+	if !SequenceGreaterThan(sequence+1, e.sentPackets.Sequence) {
+		// sent packets only go backwards if the buffer was changed under the endpoint
+		e.lossWindow.invalidate()
+		e.sentWindow.invalidate()
+		e.ackedWindow.invalidate()
+		return
+	}
+	start := sequence + 1 - uint16(e.sentPackets.NumEntries)
+	e.lossWindow.slide(start)
+	e.sentWindow.slide(start)
+	e.ackedWindow.slide(start)
+}
+
+// slideReceivedStats is called before inserting a received packet
+func (e *Endpoint) slideReceivedStats(sequence uint16) {
+	if !SequenceGreaterThan(sequence+1, e.receivedPackets.Sequence) {
+		if e.receivedWindow.contains(sequence) {
+			e.receivedWindow.invalidate()
+		}
+		return
+	}
+	e.receivedWindow.slide(sequence + 1 - uint16(e.receivedPackets.NumEntries))
+}
+
+// ackStats is called when a sent packet is acked
+func (e *Endpoint) ackStats(sequence uint16) {
+	e.lossWindow.uncount(sequence)
+	if e.ackedWindow.contains(sequence) {
+		e.ackedWindow.invalidate()
+	}
+}
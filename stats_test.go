@@ -0,0 +1,131 @@
+package rely
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/op/go-logging"
+)
+
+// scanWindow is how Update used to find the statistics of a window, by scanning the buffer
+func scanWindow(start uint16, size int, include func(uint16) (float64, uint32, bool)) (count, bytes int, startTime, finishTime float64) {
+	startTime = math.MaxFloat64
+	for i := 0; i < size; i++ {
+		time, packetBytes, ok := include(start + uint16(i))
+		if !ok {
+			continue
+		}
+		count++
+		bytes += int(packetBytes)
+		if time < startTime {
+			startTime = time
+		}
+		if time > finishTime {
+			finishTime = time
+		}
+	}
+	return count, bytes, startTime, finishTime
+}
+
+// checkWindow compares a window to a scan, and returns true if the window was kept up to date without one
+func checkWindow(t *testing.T, name string, w *windowStats, start uint16) bool {
+	t.Helper()
+	incremental := !w.invalid && w.start == start && w.sliding
+	w.sync(start)
+	count, bytes, startTime, finishTime := scanWindow(start, w.size, w.include)
+	if w.count != count || w.bytes != bytes {
+		t.Fatal(name, "window has", w.count, w.bytes, "scan has", count, bytes)
+	}
+	if w.earliest == nil {
+		return incremental
+	}
+	if actualStart, actualFinish := w.timeRange(); actualStart != startTime || actualFinish != finishTime {
+		t.Fatal(name, "window has times", actualStart, actualFinish, "scan has", startTime, finishTime)
+	}
+	return incremental
+}
+
+func TestWindowStats(t *testing.T) {
+	logging.SetLevel(logging.CRITICAL, "rely")
+
+	for _, bufferSize := range []int{256, 64, 100} {
+		random := rand.New(rand.NewSource(int64(bufferSize)))
+
+		var context testContext
+		newTestEndpoints(&context, 100, func(config *Config) {
+			config.SentPacketsBufferSize = bufferSize
+			config.ReceivedPacketsBufferSize = bufferSize
+		})
+
+		// deliver packets late, out of order, duplicated or not at all
+		var delayed [][]byte
+		context.sender.config.TransmitPacketFunction = func(_ interface{}, _ int, _ uint16, packetData []byte) {
+			if random.Intn(10) == 0 {
+				return
+			}
+			delayed = append(delayed, append([]byte(nil), packetData...))
+		}
+		deliver := func() {
+			random.Shuffle(len(delayed), func(i, j int) { delayed[i], delayed[j] = delayed[j], delayed[i] })
+			n := random.Intn(len(delayed) + 1)
+			for _, packetData := range delayed[:n] {
+				context.receiver.ReceivePacket(packetData)
+				if random.Intn(20) == 0 {
+					context.receiver.ReceivePacket(packetData)
+				}
+			}
+			delayed = append(delayed[:0], delayed[n:]...)
+		}
+
+		var incremental [4]int
+		time := 100.0
+		for i := 0; i < 70000; i++ {
+			time += random.Float64() / 30
+			context.sender.Update(time)
+			context.receiver.Update(time)
+
+			for j := random.Intn(3); j > 0; j-- {
+				context.sender.SendPacket(make([]byte, random.Intn(100)))
+			}
+			if random.Intn(3) == 0 {
+				deliver()
+			}
+			if random.Intn(4) == 0 {
+				context.receiver.SendPacket([]byte{1})
+			}
+			if random.Intn(20000) == 0 {
+				context.sender.Reset()
+				context.receiver.Reset()
+			}
+			if i%997 == 0 {
+				// a burst of loss, bigger than the windows
+				for j := 0; j < bufferSize; j++ {
+					context.sender.SendPacket([]byte{1})
+				}
+				delayed = delayed[:0]
+			}
+
+			sender, receiver := context.sender, context.receiver
+			sentStart := sender.sentPackets.Sequence - uint16(sender.sentPackets.NumEntries)
+			receivedStart := receiver.receivedPackets.Sequence - uint16(receiver.receivedPackets.NumEntries)
+			for j, ok := range []bool{
+				checkWindow(t, "loss", &sender.lossWindow, sentStart),
+				checkWindow(t, "sent", &sender.sentWindow, sentStart),
+				checkWindow(t, "acked", &sender.ackedWindow, sentStart),
+				checkWindow(t, "received", &receiver.receivedWindow, receivedStart),
+			} {
+				if ok {
+					incremental[j]++
+				}
+			}
+		}
+
+		// buffers that divide the sequence space should rarely need a scan
+		for j, n := range incremental {
+			if sliding := 65536%bufferSize == 0; sliding && n < 60000 || !sliding && n != 0 {
+				t.Error("Buffer size", bufferSize, "window", j, "was incremental", n, "times")
+			}
+		}
+	}
+}
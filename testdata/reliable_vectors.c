@@ -0,0 +1,99 @@
+/*
+    Generates reliable.txt, the golden wire-format vectors checked by compat_test.go.
+
+    Build it against a checkout of https://github.com/networkprotocol/reliable:
+
+        cc -I<path to reliable> -o reliable_vectors testdata/reliable_vectors.c -lm
+        ./reliable_vectors > testdata/reliable.txt
+*/
+
+#include "reliable.c"
+
+#include <stdio.h>
+
+static void print_bytes( const uint8_t * data, int bytes )
+{
+    for ( int i = 0; i < bytes; i++ )
+        printf( "%02x", data[i] );
+    printf( "\n" );
+}
+
+static void print_packet_header( uint16_t sequence, uint16_t ack, uint32_t ack_bits )
+{
+    uint8_t packet_data[RELIABLE_MAX_PACKET_HEADER_BYTES];
+    int bytes = reliable_write_packet_header( packet_data, sequence, ack, ack_bits );
+    printf( "packet %d %d 0x%08x ", sequence, ack, ack_bits );
+    print_bytes( packet_data, bytes );
+}
+
+static int transmit_packet_bytes;
+
+static void transmit_packet_function( void * context, uint64_t id, uint16_t sequence, uint8_t * packet_data, int packet_bytes )
+{
+    (void) context;
+    (void) id;
+    printf( "datagram %d %d ", transmit_packet_bytes, sequence );
+    print_bytes( packet_data, packet_bytes );
+}
+
+static int process_packet_function( void * context, uint64_t id, uint16_t sequence, uint8_t * packet_data, int packet_bytes )
+{
+    (void) context;
+    (void) id;
+    (void) sequence;
+    (void) packet_data;
+    (void) packet_bytes;
+    return 1;
+}
+
+int main()
+{
+    reliable_init();
+
+    printf( "# generated by testdata/reliable_vectors.c from reliable.io\n" );
+
+    /* every prefix byte combination. an ack bits byte is only written when it is not 0xFF */
+    printf( "# packet <sequence> <ack> <ack bits> <header bytes>\n" );
+    const uint32_t partial_bytes[4] = { 0x00000012, 0x00003400, 0x00560000, 0x78000000 };
+    const uint16_t sequences[2] = { 200, 10000 };
+    for ( int far = 0; far < 2; far++ )
+    {
+        for ( int mask = 0; mask < 16; mask++ )
+        {
+            uint32_t ack_bits = 0;
+            for ( int i = 0; i < 4; i++ )
+                ack_bits |= ( mask & ( 1 << i ) ) ? partial_bytes[i] : ( 0xFFu << ( 8 * i ) );
+            print_packet_header( sequences[far], 100, ack_bits );
+        }
+    }
+
+    /* sequence and ack either side of the 16 bit wrap */
+    print_packet_header( 5, 65530, 0xFFFFFFFF );
+    print_packet_header( 65535, 0, 0x00000000 );
+    print_packet_header( 0, 0, 0xFFFFFFFE );
+
+    /* datagrams transmitted by a fresh endpoint, regular and fragmented */
+    printf( "# datagram <packet bytes> <sequence> <datagram bytes>, payload byte i is i%%256\n" );
+    struct reliable_config_t config;
+    reliable_default_config( &config );
+    config.transmit_packet_function = transmit_packet_function;
+    config.process_packet_function = process_packet_function;
+
+    struct reliable_endpoint_t * endpoint = reliable_endpoint_create( &config, 100.0 );
+
+    const int packet_sizes[4] = { 8, 1024, 1025, 3000 };
+    uint8_t packet_data[3000];
+    for ( int i = 0; i < (int) sizeof( packet_data ); i++ )
+        packet_data[i] = (uint8_t) i;
+    for ( int i = 0; i < 4; i++ )
+    {
+        transmit_packet_bytes = packet_sizes[i];
+        reliable_endpoint_send_packet( endpoint, packet_data, packet_sizes[i] );
+    }
+
+    reliable_endpoint_destroy( endpoint );
+
+    reliable_term();
+
+    return 0;
+}
@@ -0,0 +1,117 @@
+package rely
+
+import (
+	"hash/crc32"
+)
+
+// Datagrams can carry a trailer after the packet or fragment, which is checked before any header parsing:
+//
+//	[packet or fragment][crc32c uint32][protocol id uint32][protocol version uint16]
+//
+// The checksum is present when Config.Checksum is set and covers the whole datagram except itself. The
+// protocol id and version are present when either is set, so that datagrams from other applications or
+// incompatible releases are rejected. They are always last so that DatagramProtocol can find them, and are
+// checked before the checksum.
+
+const (
+	// ChecksumTrailerBytes is the size of the CRC32C checksum in the trailer
+	ChecksumTrailerBytes = 4
+	// ProtocolTrailerBytes is the size of the protocol id and version at the end of every datagram
+	ProtocolTrailerBytes = 6
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// DatagramProtocol returns the protocol id and version from the end of a datagram sent by an endpoint
+// with a protocol id or version configured. This lets a server pick the endpoint configuration matching
+// a client during rolling upgrades.
+func DatagramProtocol(packetData []byte) (protocolId uint32, protocolVersion uint16, ok bool) {
+	if len(packetData) < ProtocolTrailerBytes {
+		return 0, 0, false
+	}
+	p := buffer{buf: packetData[len(packetData)-ProtocolTrailerBytes:]}
+	protocolId, _ = p.getUint32()
+	protocolVersion, _ = p.getUint16()
+	return protocolId, protocolVersion, true
+}
+
+// hasProtocol returns true if datagrams should carry the protocol trailer
+func (c *Config) hasProtocol() bool {
+	return !c.ReliableIOCompatible && (c.ProtocolId != 0 || c.ProtocolVersion != 0)
+}
+
+// hasChecksum returns true if datagrams should carry a checksum
+func (c *Config) hasChecksum() bool {
+	return !c.ReliableIOCompatible && c.Checksum
+}
+
+// trailerBytes returns the number of bytes appended to every datagram
+func (c *Config) trailerBytes() int {
+	var n int
+	if c.hasChecksum() {
+		n += ChecksumTrailerBytes
+	}
+	if c.hasProtocol() {
+		n += ProtocolTrailerBytes
+	}
+	return n
+}
+
+// transmitPacket appends the trailer to the datagram, which must have capacity for it, then transmits it
+func (e *Endpoint) transmitPacket(sequence uint16, packetData []byte) {
+	if e.trailerBytes > 0 {
+		n := len(packetData)
+		packetData = packetData[:n+e.trailerBytes]
+		p := buffer{buf: packetData, pos: n}
+		if e.config.hasChecksum() {
+			p.pos += ChecksumTrailerBytes
+		}
+		if e.config.hasProtocol() {
+			p.writeUint32(e.config.ProtocolId)
+			p.writeUint16(e.config.ProtocolVersion)
+		}
+		if e.config.hasChecksum() {
+			p.pos = n
+			p.writeUint32(checksum(packetData, n))
+		}
+	}
+	e.config.TransmitPacketFunction(e.config.Context, e.config.Index, sequence, packetData)
+}
+
+// readTrailer checks the trailer of a received datagram and returns the datagram without it. The protocol
+// is checked first, so that datagrams from other applications are not counted as corrupt.
+func (e *Endpoint) readTrailer(packetData []byte) ([]byte, bool) {
+	if e.trailerBytes == 0 {
+		return packetData, true
+	}
+	if e.config.hasProtocol() {
+		protocolId, protocolVersion, ok := DatagramProtocol(packetData)
+		if !ok || protocolId != e.config.ProtocolId || protocolVersion != e.config.ProtocolVersion {
+			log.Errorf("[%s] ignoring packet from a different protocol. got id %d version %d", e.config.Name, protocolId, protocolVersion)
+			e.counters[counterNumPacketsWrongProtocol]++
+			return nil, false
+		}
+	}
+	if e.config.hasChecksum() {
+		n := len(packetData) - e.trailerBytes
+		if n < 0 {
+			log.Errorf("[%s] ignoring packet too small for trailer", e.config.Name)
+			e.counters[counterNumPacketsCorrupt]++
+			return nil, false
+		}
+		p := buffer{buf: packetData, pos: n}
+		crc, _ := p.getUint32()
+		if crc != checksum(packetData, n) {
+			log.Errorf("[%s] ignoring corrupt packet. checksum mismatch", e.config.Name)
+			e.counters[counterNumPacketsCorrupt]++
+			return nil, false
+		}
+	}
+	return packetData[:len(packetData)-e.trailerBytes], true
+}
+
+// checksum returns the CRC32C of the datagram, skipping the checksum itself which is at offset n
+func checksum(packetData []byte, n int) uint32 {
+	crc := crc32.Update(0, crcTable, packetData[:n])
+	return crc32.Update(crc, crcTable, packetData[n+ChecksumTrailerBytes:])
+}